@@ -3,20 +3,31 @@ package main
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/domnikl/music-box-game/backend/internal/controllers"
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/middlewares"
 	"github.com/domnikl/music-box-game/backend/internal/repositories"
 	"github.com/domnikl/music-box-game/backend/internal/routes"
 	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/domnikl/music-box-game/backend/internal/sessionstore"
 	"github.com/domnikl/music-box-game/backend/internal/spotify"
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"github.com/pressly/goose/v3"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+const cleanupInterval = 15 * time.Minute
+
 func GetRequiredEnvValue(name string) string {
 	value := os.Getenv(name)
 	if value == "" {
@@ -27,11 +38,126 @@ func GetRequiredEnvValue(name string) string {
 	return value
 }
 
+// loadKeyring reads the keys used to encrypt Spotify tokens from TOKEN_ENCRYPTION_KEYS or the file
+// given in TOKEN_ENCRYPTION_KEYS_FILE.
+func loadKeyring() (*crypto.Keyring, error) {
+	if path := os.Getenv("TOKEN_ENCRYPTION_KEYS_FILE"); path != "" {
+		return crypto.ReadKeyringFile(path)
+	}
+
+	return crypto.ParseKeyring(GetRequiredEnvValue("TOKEN_ENCRYPTION_KEYS"))
+}
+
+// GetPositiveIntEnvValue returns the value of the environment variable as a positive number or defaultValue if it is not set.
+func GetPositiveIntEnvValue(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		slog.Error(fmt.Sprintf("%s must be a positive number", name))
+		os.Exit(1)
+	}
+
+	return number
+}
+
+// loadIPExtractor determines how the client IP used for rate limiting is read. Without TRUSTED_PROXIES,
+// the IP the request has been sent from is used and X-Forwarded-For is ignored, so clients can't pick
+// an IP of their own. Otherwise X-Forwarded-For is read as far as it has been set by the trusted proxies.
+func loadIPExtractor() (echo.IPExtractor, error) {
+	value := os.Getenv("TRUSTED_PROXIES")
+	if value == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+
+	for _, proxy := range strings.Split(value, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES contains an invalid IP or range: %w", err)
+		}
+
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// loadRegistrationConfig reads how POST /auth is protected. It requires the app secret by default.
+func loadRegistrationConfig() (services.RegistrationConfig, error) {
+	modeValue := os.Getenv("REGISTRATION_MODE")
+	if modeValue == "" {
+		modeValue = string(services.RegistrationAppSecret)
+	}
+
+	mode, err := services.ParseRegistrationMode(modeValue)
+	if err != nil {
+		return services.RegistrationConfig{}, err
+	}
+
+	config := services.RegistrationConfig{Mode: mode, AppSecret: os.Getenv("REGISTRATION_APP_SECRET")}
+
+	if key := os.Getenv("REGISTRATION_INVITE_KEY"); key != "" {
+		if config.InviteSigner, err = crypto.NewSigner([]byte(key)); err != nil {
+			return services.RegistrationConfig{}, fmt.Errorf("REGISTRATION_INVITE_KEY is invalid: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// deleteExpiredPeriodically removes expired sessions, login tickets, OAuth states, guests and merge
+// requests from the database and forgets the events of games that have been idle for a while.
+func deleteExpiredPeriodically(sessionStore *sessionstore.Store, loginTicketService *services.LoginTicketService, userService *services.UserService, hub *events.Hub) {
+	for range time.Tick(cleanupInterval) {
+		hub.DeleteExpired()
+
+		if err := sessionStore.DeleteExpired(); err != nil {
+			slog.Error("Failed to delete expired sessions: " + err.Error())
+		}
+
+		if err := loginTicketService.DeleteExpired(); err != nil {
+			slog.Error("Failed to delete expired login tickets: " + err.Error())
+		}
+
+		if err := userService.DeleteExpiredGuests(); err != nil {
+			slog.Error("Failed to delete expired guests: " + err.Error())
+		}
+
+		if err := userService.DeleteExpiredMergeRequests(); err != nil {
+			slog.Error("Failed to delete expired merge requests: " + err.Error())
+		}
+	}
+}
+
 func main() {
 	spotifyClientID := GetRequiredEnvValue("SPOTIFY_CLIENT_ID")
 	spotifyClientSecret := GetRequiredEnvValue("SPOTIFY_CLIENT_SECRET")
 	spotifyRedirectURL := GetRequiredEnvValue("SPOTIFY_REDIRECT_URI")
 
+	sessionSecret := GetRequiredEnvValue("SESSION_SECRET")
+	if err := crypto.CheckSecret(sessionSecret); err != nil {
+		slog.Error("SESSION_SECRET is too weak: " + err.Error())
+		os.Exit(1)
+	}
+
 	db, err := gorm.Open(postgres.Open(GetRequiredEnvValue("DB_DSN")), &gorm.Config{})
 	if err != nil {
 		panic(err)
@@ -51,16 +177,174 @@ func main() {
 		os.Exit(1)
 	}
 
+	tokenHasher, err := crypto.NewTokenHasher([]byte(GetRequiredEnvValue("API_TOKEN_HASH_KEY")))
+	if err != nil {
+		slog.Error("API_TOKEN_HASH_KEY is invalid: " + err.Error())
+		os.Exit(1)
+	}
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		slog.Error("Failed to load token encryption keys: " + err.Error())
+		os.Exit(1)
+	}
+
+	userRepository := repositories.NewUserRepository(db, keyring)
+
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt-tokens" {
+		updated, err := userRepository.ReencryptSpotifyTokens()
+		if err != nil {
+			slog.Error("Failed to re-encrypt Spotify tokens: " + err.Error())
+			os.Exit(1)
+		}
+
+		slog.Info(fmt.Sprintf("Re-encrypted Spotify tokens of %d users with key %s", updated, keyring.PrimaryID()))
+		return
+	}
+
+	userService := services.NewUserService(userRepository, repositories.NewMergeRequestRepository(db))
+	apiTokenService := services.NewAPITokenService(repositories.NewAPITokenRepository(db), userRepository, tokenHasher)
+
+	// tokens of users created before API tokens have been hashed are hashed now
+	hashed, err := apiTokenService.HashPlaintextAPITokens()
+	if err != nil {
+		slog.Error("Failed to hash plaintext API tokens: " + err.Error())
+		os.Exit(1)
+	}
+
+	if hashed > 0 {
+		slog.Info(fmt.Sprintf("Hashed %d plaintext API tokens", hashed))
+	}
+
+	registrationConfig, err := loadRegistrationConfig()
+	if err != nil {
+		slog.Error("Failed to configure registration: " + err.Error())
+		os.Exit(1)
+	}
+
+	hub := events.NewHub()
+	transactor := repositories.NewTransactor(db)
+	gameService := services.NewGameService(repositories.NewGameRepository(db), userService, hub, transactor)
+
+	registrationService, err := services.NewRegistrationService(
+		registrationConfig,
+		userService,
+		apiTokenService,
+		gameService,
+		repositories.NewInviteRepository(db),
+		transactor,
+	)
+	if err != nil {
+		slog.Error("Failed to configure registration: " + err.Error())
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "create-invite" {
+		validFor := 7 * 24 * time.Hour
+		if len(os.Args) > 2 {
+			if validFor, err = time.ParseDuration(os.Args[2]); err != nil {
+				slog.Error("Invalid validity of the invite: " + err.Error())
+				os.Exit(1)
+			}
+		}
+
+		invite, err := registrationService.CreateInvite(validFor)
+		if err != nil {
+			slog.Error("Failed to create invite: " + err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println(invite)
+		return
+	}
+
+	routesConfig := routes.Config{
+		RegistrationLimits: routes.RegistrationLimits{
+			PerIP: middlewares.RateLimit{
+				Count:  GetPositiveIntEnvValue("REGISTRATION_LIMIT_PER_IP", 5),
+				Period: time.Hour,
+				Burst:  GetPositiveIntEnvValue("REGISTRATION_LIMIT_PER_IP", 5),
+			},
+			Global: middlewares.RateLimit{
+				Count:  GetPositiveIntEnvValue("REGISTRATION_LIMIT_GLOBAL", 100),
+				Period: time.Hour,
+				Burst:  GetPositiveIntEnvValue("REGISTRATION_LIMIT_GLOBAL", 100),
+			},
+			GuestPerCode: middlewares.RateLimit{
+				Count:  GetPositiveIntEnvValue("GUEST_LIMIT_PER_CODE", 50),
+				Period: time.Hour,
+				Burst:  GetPositiveIntEnvValue("GUEST_LIMIT_PER_CODE", 50),
+			},
+			GuestGlobal: middlewares.RateLimit{
+				Count:  GetPositiveIntEnvValue("GUEST_LIMIT_GLOBAL", 1000),
+				Period: time.Hour,
+				Burst:  GetPositiveIntEnvValue("GUEST_LIMIT_GLOBAL", 1000),
+			},
+		},
+		AllowQueryAPIToken: os.Getenv("ALLOW_QUERY_API_TOKEN") != "false",
+	}
+
+	var appRedirectURIs []string
+	for _, uri := range strings.Split(os.Getenv("APP_REDIRECT_URIS"), ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			appRedirectURIs = append(appRedirectURIs, uri)
+		}
+	}
+
+	loginTicketService := services.NewLoginTicketService(
+		repositories.NewLoginTicketRepository(db),
+		repositories.NewOAuthStateRepository(db),
+		userRepository,
+		tokenHasher,
+		appRedirectURIs,
+	)
+
+	var spotifyOptions []spotify.Option
+	if value := os.Getenv("SPOTIFY_MAX_PLAYLIST_TRACKS"); value != "" {
+		spotifyOptions = append(spotifyOptions, spotify.WithMaxPlaylistTracks(GetPositiveIntEnvValue("SPOTIFY_MAX_PLAYLIST_TRACKS", 0)))
+	}
+
 	spotifyClient := spotify.NewSpotify(
 		spotifyClientID,
 		spotifyClientSecret,
 		spotifyRedirectURL,
-		services.NewUserService(repositories.NewUserRepository(db)),
+		userService,
+		spotifyOptions...,
 	)
 
+	releaseYearService := services.NewReleaseYearService()
+	if path := os.Getenv("RELEASE_YEAR_REFERENCE_CSV"); path != "" {
+		if err = releaseYearService.LoadReferenceFile(path); err != nil {
+			slog.Error("Failed to load release year reference data: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
 	e := echo.New()
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))))
-	routes.Setup(e, db, spotifyClient)
+	e.HTTPErrorHandler = controllers.HTTPErrorHandler
+	if e.IPExtractor, err = loadIPExtractor(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	e.Use(middleware.RequestID())
+	sessionStore := sessionstore.New(repositories.NewSessionRepository(db), []byte(sessionSecret))
+	e.Use(session.Middleware(sessionStore))
+
+	go deleteExpiredPeriodically(sessionStore, loginTicketService, userService, hub)
+
+	routes.Setup(
+		e,
+		routesConfig,
+		userService,
+		apiTokenService,
+		loginTicketService,
+		registrationService,
+		gameService,
+		hub,
+		spotifyClient,
+		releaseYearService,
+	)
 
 	e.Logger.Fatal(e.Start(":8080"))
 }
@@ -0,0 +1,62 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE "games" (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES "users" (id),
+  playlist_id VARCHAR(64) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  max_rounds INTEGER NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  deleted_at TIMESTAMP
+);
+
+CREATE INDEX idx_games_user_id ON "games" (user_id);
+CREATE INDEX idx_games_deleted_at ON "games" (deleted_at);
+
+CREATE TABLE "players" (
+  id SERIAL PRIMARY KEY,
+  game_id INTEGER NOT NULL REFERENCES "games" (id) ON DELETE CASCADE,
+  user_id INTEGER REFERENCES "users" (id),
+  name VARCHAR(64) NOT NULL,
+  score INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_players_game_id ON "players" (game_id);
+
+CREATE TABLE "rounds" (
+  id SERIAL PRIMARY KEY,
+  game_id INTEGER NOT NULL REFERENCES "games" (id) ON DELETE CASCADE,
+  number INTEGER NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  track_id VARCHAR(64) NOT NULL,
+  track_name VARCHAR(255) NOT NULL,
+  artist_name VARCHAR(255) NOT NULL,
+  album_name VARCHAR(255) NOT NULL,
+  release_date VARCHAR(10) NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (game_id, number)
+);
+
+CREATE TABLE "guesses" (
+  id SERIAL PRIMARY KEY,
+  round_id INTEGER NOT NULL REFERENCES "rounds" (id) ON DELETE CASCADE,
+  player_id INTEGER NOT NULL REFERENCES "players" (id) ON DELETE CASCADE,
+  year INTEGER NOT NULL,
+  points INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (round_id, player_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE "guesses";
+DROP TABLE "rounds";
+DROP TABLE "players";
+DROP TABLE "games";
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "games"
+  ADD COLUMN mode VARCHAR(16) NOT NULL DEFAULT 'classic',
+  ADD COLUMN target_cards INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN winner_id INTEGER REFERENCES "players" (id);
+
+ALTER TABLE "guesses"
+  ALTER COLUMN year SET DEFAULT 0,
+  ADD COLUMN position INTEGER,
+  ADD COLUMN correct BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE "timeline_cards" (
+  id SERIAL PRIMARY KEY,
+  player_id INTEGER NOT NULL REFERENCES "players" (id) ON DELETE CASCADE,
+  track_id VARCHAR(64) NOT NULL,
+  track_name VARCHAR(255) NOT NULL,
+  artist_name VARCHAR(255) NOT NULL,
+  release_year INTEGER NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_timeline_cards_player_id ON "timeline_cards" (player_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE "timeline_cards";
+
+ALTER TABLE "guesses"
+  DROP COLUMN correct,
+  DROP COLUMN position,
+  ALTER COLUMN year DROP DEFAULT;
+
+ALTER TABLE "games"
+  DROP COLUMN winner_id,
+  DROP COLUMN target_cards,
+  DROP COLUMN mode;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "rounds"
+  ADD COLUMN release_date_precision VARCHAR(8) NOT NULL DEFAULT '',
+  ADD COLUMN unscored BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "rounds"
+  DROP COLUMN unscored,
+  DROP COLUMN release_date_precision;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "rounds"
+  ADD COLUMN original_year INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN original_year_source VARCHAR(16) NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "rounds"
+  DROP COLUMN original_year_source,
+  DROP COLUMN original_year;
+-- +goose StatementEnd
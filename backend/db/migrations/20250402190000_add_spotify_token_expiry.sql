@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "users"
+  ADD COLUMN spotify_token_expires_at TIMESTAMP,
+  ADD COLUMN spotify_link_broken_at TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "users"
+  DROP COLUMN spotify_link_broken_at,
+  DROP COLUMN spotify_token_expires_at;
+-- +goose StatementEnd
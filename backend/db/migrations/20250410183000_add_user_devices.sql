@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "users"
+  ADD COLUMN preferred_device_id VARCHAR(255) NOT NULL DEFAULT '',
+  ADD COLUMN last_device_id VARCHAR(255) NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "users"
+  DROP COLUMN last_device_id,
+  DROP COLUMN preferred_device_id;
+-- +goose StatementEnd
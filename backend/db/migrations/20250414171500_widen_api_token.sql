@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "users" ALTER COLUMN api_token TYPE VARCHAR(255);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "users" ALTER COLUMN api_token TYPE VARCHAR(64);
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- api_token holds plaintext tokens of existing users until they have been hashed on startup
+ALTER TABLE "users"
+  ALTER COLUMN api_token DROP NOT NULL,
+  ADD COLUMN api_token_prefix VARCHAR(16),
+  ADD COLUMN api_token_hash VARCHAR(64) UNIQUE;
+
+CREATE INDEX idx_users_api_token_prefix ON "users" (api_token_prefix);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_users_api_token_prefix;
+
+ALTER TABLE "users"
+  DROP COLUMN api_token_hash,
+  DROP COLUMN api_token_prefix;
+-- +goose StatementEnd
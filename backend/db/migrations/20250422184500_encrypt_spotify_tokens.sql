@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- encrypted tokens are longer than the plaintext ones
+ALTER TABLE "users"
+  ALTER COLUMN spotify_token TYPE TEXT,
+  ALTER COLUMN spotify_refresh_token TYPE TEXT,
+  ADD COLUMN spotify_token_key_id VARCHAR(64) NOT NULL DEFAULT '',
+  ADD COLUMN spotify_token_data_key TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "users"
+  DROP COLUMN spotify_token_data_key,
+  DROP COLUMN spotify_token_key_id,
+  ALTER COLUMN spotify_refresh_token TYPE VARCHAR(255),
+  ALTER COLUMN spotify_token TYPE VARCHAR(255);
+-- +goose StatementEnd
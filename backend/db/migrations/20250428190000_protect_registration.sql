@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "users" ADD COLUMN created_via VARCHAR(32) NOT NULL DEFAULT '';
+
+CREATE TABLE "invites" (
+  id VARCHAR(32) PRIMARY KEY,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP,
+  used_by_user_id INTEGER REFERENCES "users" (id) ON DELETE SET NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE "invites";
+
+ALTER TABLE "users" DROP COLUMN created_via;
+-- +goose StatementEnd
@@ -0,0 +1,51 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE "api_tokens" (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+  name VARCHAR(64) NOT NULL,
+  prefix VARCHAR(16) NOT NULL,
+  hash VARCHAR(64) UNIQUE NOT NULL,
+  last_used_at TIMESTAMP,
+  expires_at TIMESTAMP,
+  revoked_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_api_tokens_user_id ON "api_tokens" (user_id);
+CREATE INDEX idx_api_tokens_prefix ON "api_tokens" (prefix);
+
+-- every user keeps the token it has been created with
+INSERT INTO "api_tokens" (user_id, name, prefix, hash, created_at, updated_at)
+SELECT id, 'Default', api_token_prefix, api_token_hash, created_at, created_at
+FROM "users"
+WHERE api_token_hash IS NOT NULL;
+
+DROP INDEX idx_users_api_token_prefix;
+
+ALTER TABLE "users"
+  DROP COLUMN api_token_hash,
+  DROP COLUMN api_token_prefix;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "users"
+  ADD COLUMN api_token_prefix VARCHAR(16),
+  ADD COLUMN api_token_hash VARCHAR(64) UNIQUE;
+
+CREATE INDEX idx_users_api_token_prefix ON "users" (api_token_prefix);
+
+-- users can only keep a single token, the oldest one that is still valid
+UPDATE "users" SET api_token_prefix = t.prefix, api_token_hash = t.hash
+FROM (
+  SELECT DISTINCT ON (user_id) user_id, prefix, hash
+  FROM "api_tokens"
+  WHERE revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+  ORDER BY user_id, id
+) t
+WHERE "users".id = t.user_id;
+
+DROP TABLE "api_tokens";
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE "login_tickets" (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+  hash VARCHAR(64) UNIQUE NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_login_tickets_expires_at ON "login_tickets" (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE "login_tickets";
+-- +goose StatementEnd
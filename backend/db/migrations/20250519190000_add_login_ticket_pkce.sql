@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "login_tickets"
+  ADD COLUMN redirect_uri VARCHAR(255) NOT NULL DEFAULT '',
+  ADD COLUMN code_verifier VARCHAR(128) NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "login_tickets"
+  DROP COLUMN code_verifier,
+  DROP COLUMN redirect_uri;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE "oauth_states" (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+  hash VARCHAR(64) UNIQUE NOT NULL,
+  redirect_uri VARCHAR(255) NOT NULL DEFAULT '',
+  code_verifier VARCHAR(128) NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_oauth_states_expires_at ON "oauth_states" (expires_at);
+
+CREATE TABLE "sessions" (
+  id VARCHAR(64) PRIMARY KEY,
+  data TEXT NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_sessions_expires_at ON "sessions" (expires_at);
+
+-- the PKCE verifier is kept with the OAuth state now
+ALTER TABLE "login_tickets" DROP COLUMN code_verifier;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "login_tickets" ADD COLUMN code_verifier VARCHAR(128) NOT NULL DEFAULT '';
+
+DROP TABLE "sessions";
+DROP TABLE "oauth_states";
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "users"
+  ADD COLUMN spotify_user_id VARCHAR(255) NOT NULL DEFAULT '',
+  ADD COLUMN spotify_display_name VARCHAR(255) NOT NULL DEFAULT '',
+  ADD COLUMN spotify_country VARCHAR(8) NOT NULL DEFAULT '',
+  ADD COLUMN spotify_product VARCHAR(32) NOT NULL DEFAULT '',
+  ADD COLUMN spotify_avatar_url TEXT NOT NULL DEFAULT '';
+
+-- a Spotify account can only be linked to a single user
+CREATE UNIQUE INDEX idx_users_spotify_user_id ON "users" (spotify_user_id)
+  WHERE spotify_user_id <> '' AND deleted_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_users_spotify_user_id;
+
+ALTER TABLE "users"
+  DROP COLUMN spotify_avatar_url,
+  DROP COLUMN spotify_product,
+  DROP COLUMN spotify_country,
+  DROP COLUMN spotify_display_name,
+  DROP COLUMN spotify_user_id;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "games"
+  ADD COLUMN playback VARCHAR(32) NOT NULL DEFAULT 'remote';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "games"
+  DROP COLUMN playback;
+-- +goose StatementEnd
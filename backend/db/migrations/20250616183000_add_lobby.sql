@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "games"
+  ADD COLUMN join_code VARCHAR(8) NOT NULL DEFAULT '',
+  ADD COLUMN join_code_expires_at TIMESTAMP;
+
+-- a code identifies a single game until it has expired and been cleared
+CREATE UNIQUE INDEX idx_games_join_code ON "games" (join_code) WHERE join_code <> '';
+
+ALTER TABLE "players"
+  ADD COLUMN ready BOOLEAN NOT NULL DEFAULT false;
+
+-- users join a game only once
+CREATE UNIQUE INDEX idx_players_game_id_user_id ON "players" (game_id, user_id) WHERE user_id IS NOT NULL;
+CREATE INDEX idx_players_user_id ON "players" (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_players_user_id;
+DROP INDEX idx_players_game_id_user_id;
+
+ALTER TABLE "players"
+  DROP COLUMN ready;
+
+DROP INDEX idx_games_join_code;
+
+ALTER TABLE "games"
+  DROP COLUMN join_code_expires_at,
+  DROP COLUMN join_code;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- guests are users scoped to a single game, they are deleted along with it
+ALTER TABLE "users"
+  ADD COLUMN guest_game_id INTEGER REFERENCES "games" (id) ON DELETE CASCADE;
+
+CREATE INDEX idx_users_guest_game_id ON "users" (guest_game_id) WHERE guest_game_id IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_users_guest_game_id;
+
+ALTER TABLE "users"
+  DROP COLUMN guest_game_id;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE "merge_requests" (
+  id SERIAL PRIMARY KEY,
+  from_user_id INTEGER UNIQUE NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+  into_user_id INTEGER NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+  expires_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_merge_requests_into_user_id ON "merge_requests" (into_user_id);
+CREATE INDEX idx_merge_requests_expires_at ON "merge_requests" (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE "merge_requests";
+-- +goose StatementEnd
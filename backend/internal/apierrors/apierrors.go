@@ -0,0 +1,37 @@
+// Package apierrors contains errors that are returned to API clients as they are.
+// All other errors are mapped to a status and error code by the controllers' error handler.
+package apierrors
+
+import (
+	"net/http"
+	"time"
+)
+
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	// RetryAfter is sent to the client as a hint when to try again, if set
+	RetryAfter time.Duration
+}
+
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, "bad_request", message)
+}
+
+func TooManyRequests(message string, retryAfter time.Duration) *Error {
+	return &Error{Status: http.StatusTooManyRequests, Code: "rate_limited", Message: message, RetryAfter: retryAfter}
+}
+
+var (
+	ErrUnauthorized     = New(http.StatusUnauthorized, "unauthorized", "Unauthorized")
+	ErrSpotifyNotLinked = New(http.StatusUnauthorized, "spotify_not_linked", "Missing Spotify token")
+)
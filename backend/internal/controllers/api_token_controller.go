@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/labstack/echo/v4"
+)
+
+type APITokenController struct {
+	apiTokenService *services.APITokenService
+}
+
+func NewAPITokenController(apiTokenService *services.APITokenService) *APITokenController {
+	return &APITokenController{apiTokenService: apiTokenService}
+}
+
+// apiTokenResponse is an API token along with its plaintext, which is only returned when it is created or rotated.
+type apiTokenResponse struct {
+	*models.APIToken
+	Token string `json:"token,omitempty"`
+	// Current is set for the token used for the request.
+	Current bool `json:"current"`
+}
+
+func (a *APITokenController) GetTokens(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+	current := c.Get("apiToken").(*models.APIToken)
+
+	tokens, err := a.apiTokenService.FindTokens(user)
+	if err != nil {
+		return fmt.Errorf("failed to find API tokens: %w", err)
+	}
+
+	response := make([]apiTokenResponse, 0, len(tokens))
+	for i := range tokens {
+		response = append(response, apiTokenResponse{APIToken: &tokens[i], Current: tokens[i].ID == current.ID})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *APITokenController) CreateToken(c echo.Context) error {
+	type createTokenRequest struct {
+		Name          string `json:"name"`
+		ExpiresInDays int    `json:"expiresInDays"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	var req createTokenRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	if req.ExpiresInDays < 0 {
+		return apierrors.BadRequest("expiresInDays must not be negative")
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	token, plaintext, err := a.apiTokenService.CreateToken(user, req.Name, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create API token: %w", err)
+	}
+
+	return c.JSON(http.StatusCreated, apiTokenResponse{APIToken: token, Token: plaintext})
+}
+
+func (a *APITokenController) RotateToken(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+	current := c.Get("apiToken").(*models.APIToken)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return apierrors.BadRequest("Invalid token ID")
+	}
+
+	token, plaintext, err := a.apiTokenService.RotateToken(user, uint(id))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, apiTokenResponse{APIToken: token, Token: plaintext, Current: token.ID == current.ID})
+}
+
+func (a *APITokenController) RevokeToken(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return apierrors.BadRequest("Invalid token ID")
+	}
+
+	if err := a.apiTokenService.RevokeToken(user, uint(id)); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
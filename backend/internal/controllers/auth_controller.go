@@ -1,30 +1,106 @@
 package controllers
 
 import (
-	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"fmt"
+	"net/http"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
 	"github.com/domnikl/music-box-game/backend/internal/models"
 	"github.com/domnikl/music-box-game/backend/internal/services"
 	"github.com/labstack/echo/v4"
 )
 
+const appSecretHeader = "X-App-Secret"
+
 type AuthController struct {
-	userService *services.UserService
+	registrationService *services.RegistrationService
 }
 
-func NewAuthController(userService *services.UserService) *AuthController {
-	return &AuthController{userService: userService}
+func NewAuthController(registrationService *services.RegistrationService) *AuthController {
+	return &AuthController{registrationService: registrationService}
 }
 
 func (a *AuthController) InitAuth(c echo.Context) error {
+	type initAuthRequest struct {
+		InviteCode string `json:"inviteCode"`
+		// DeviceName names the API token that is created along with the user
+		DeviceName string `json:"deviceName"`
+	}
+
+	// the API token is only ever returned here, the user just keeps its hash
+	type initAuthResponse struct {
+		*models.User
+		APIToken string `json:"apiToken"`
+	}
+
+	var req initAuthRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
 	// creates a new user with a random secret
-	user := &models.User{APIToken: crypto.RandomAlphaNumericString(64)}
+	user, apiToken, err := a.registrationService.Register(c.Request().Header.Get(appSecretHeader), req.InviteCode, req.DeviceName)
+	if err != nil {
+		return fmt.Errorf("could not create user: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, initAuthResponse{User: user, APIToken: apiToken})
+}
+
+// GuestAuth lets someone join a game with its join code without registering. The guest can only take part
+// in that game and expires along with it.
+func (a *AuthController) GuestAuth(c echo.Context) error {
+	type guestAuthRequest struct {
+		Code       string `json:"code"`
+		Nickname   string `json:"nickname"`
+		DeviceName string `json:"deviceName"`
+	}
+
+	type guestAuthResponse struct {
+		*models.User
+		APIToken string         `json:"apiToken"`
+		Game     *models.Game   `json:"game"`
+		Player   *models.Player `json:"player"`
+	}
+
+	var req guestAuthRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return apierrors.BadRequest("code is required")
+	}
+
+	user, game, player, apiToken, err := a.registrationService.RegisterGuest(req.Code, req.Nickname, req.DeviceName)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, guestAuthResponse{User: user, APIToken: apiToken, Game: redactGame(game), Player: player})
+}
+
+// Upgrade turns a guest into a full user, which keeps the games it has played. The guest's API token is
+// revoked, the app has to use the one returned from now on.
+func (a *AuthController) Upgrade(c echo.Context) error {
+	type upgradeRequest struct {
+		InviteCode string `json:"inviteCode"`
+		DeviceName string `json:"deviceName"`
+	}
+
+	type upgradeResponse struct {
+		*models.User
+		APIToken string `json:"apiToken"`
+	}
+
+	user := c.Get("user").(*models.User)
+	token := c.Get("apiToken").(*models.APIToken)
+
+	var req upgradeRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
 
-	err := a.userService.CreateUser(user)
+	apiToken, err := a.registrationService.UpgradeGuest(user, token, c.Request().Header.Get(appSecretHeader), req.InviteCode, req.DeviceName)
 	if err != nil {
-		return c.JSON(500, map[string]string{
-			"message": "could not create user",
-		})
+		return err
 	}
 
-	return c.JSON(200, user)
+	return c.JSON(http.StatusOK, upgradeResponse{User: user, APIToken: apiToken})
 }
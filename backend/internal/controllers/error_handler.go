@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+	"github.com/labstack/echo/v4"
+)
+
+type errorResponse struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RequestID  string `json:"requestId"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// domainErrors maps errors of the spotify and service layers to a status and a stable error code the
+// app can rely on. If message is empty, the message of the error itself is used.
+var domainErrors = []struct {
+	err     error
+	status  int
+	code    string
+	message string
+}{
+	{spotify.ErrNotFound, http.StatusNotFound, "not_found", "Not found on Spotify"},
+	{spotify.ErrNoActiveDevice, http.StatusConflict, "no_active_device", "No active device, please open Spotify on a device"},
+	{spotify.ErrPremiumRequired, http.StatusForbidden, "premium_required", "Playback control requires Spotify Premium"},
+	{spotify.ErrTokenRevoked, http.StatusUnauthorized, "spotify_token_revoked", "Spotify link is broken, please link Spotify again"},
+	{spotify.ErrUpstreamUnavailable, http.StatusServiceUnavailable, "upstream_unavailable", "Spotify is currently unavailable"},
+	{services.ErrRegistrationForbidden, http.StatusForbidden, "registration_forbidden", ""},
+	{services.ErrInvalidInvite, http.StatusForbidden, "invalid_invite", ""},
+	{services.ErrNotGuest, http.StatusConflict, "not_guest", ""},
+	{services.ErrGuestNotAllowed, http.StatusForbidden, "guest_forbidden", ""},
+	{services.ErrInvalidAPITokenName, http.StatusBadRequest, "invalid_api_token_name", ""},
+	{services.ErrSpotifyAccountLinked, http.StatusConflict, "spotify_account_linked", ""},
+	{services.ErrMergeRequestNotFound, http.StatusNotFound, "merge_request_not_found", ""},
+	{services.ErrAPITokenNotFound, http.StatusNotFound, "api_token_not_found", ""},
+	{services.ErrAPITokenRevoked, http.StatusConflict, "api_token_revoked", ""},
+	{services.ErrInvalidRedirectURI, http.StatusBadRequest, "invalid_redirect_uri", ""},
+	{services.ErrInvalidLoginTicket, http.StatusUnauthorized, "invalid_login_ticket", ""},
+	{services.ErrInvalidOAuthState, http.StatusBadRequest, "invalid_oauth_state", ""},
+	{services.ErrGameNotFound, http.StatusNotFound, "game_not_found", ""},
+	{services.ErrPlayerNotFound, http.StatusNotFound, "player_not_found", ""},
+	{services.ErrInvalidGameMode, http.StatusBadRequest, "invalid_game_mode", ""},
+	{services.ErrInvalidPlayback, http.StatusBadRequest, "invalid_playback", ""},
+	{services.ErrInvalidPosition, http.StatusBadRequest, "invalid_position", ""},
+	{services.ErrGameFinished, http.StatusConflict, "game_finished", ""},
+	{services.ErrRoundNotFinished, http.StatusConflict, "round_not_finished", ""},
+	{services.ErrNoRoundPlaying, http.StatusConflict, "no_round_playing", ""},
+	{services.ErrAlreadyGuessed, http.StatusConflict, "already_guessed", ""},
+	{services.ErrNoTracksLeft, http.StatusConflict, "no_tracks_left", ""},
+	{services.ErrNotEnoughPlayers, http.StatusConflict, "not_enough_players", ""},
+	{services.ErrNotGameHost, http.StatusForbidden, "not_game_host", ""},
+	{services.ErrForeignPlayer, http.StatusForbidden, "foreign_player", ""},
+	{services.ErrGameStarted, http.StatusConflict, "game_started", ""},
+	{services.ErrInvalidJoinCode, http.StatusNotFound, "invalid_join_code", ""},
+	{services.ErrInvalidNickname, http.StatusBadRequest, "invalid_nickname", ""},
+	{services.ErrNicknameTaken, http.StatusConflict, "nickname_taken", ""},
+	{services.ErrPlayersNotReady, http.StatusConflict, "players_not_ready", ""},
+	{services.ErrHostNeedsSpotify, http.StatusConflict, "host_needs_spotify", ""},
+}
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusRequestEntityTooLarge: "request_too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusServiceUnavailable:    "upstream_unavailable",
+}
+
+// HTTPErrorHandler renders every error returned by a handler or middleware in the same JSON envelope,
+// including the ID of the request so it can be found in the logs.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status, response := errorToResponse(err)
+	response.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	if status >= http.StatusInternalServerError {
+		slog.Error("Request failed", "error", err, "request_id", response.RequestID, "path", c.Path())
+	}
+
+	if response.RetryAfter > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(response.RetryAfter))
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, response)
+	}
+
+	if err != nil {
+		slog.Error("Failed to send error response: " + err.Error())
+	}
+}
+
+func errorToResponse(err error) (int, errorResponse) {
+	var apiError *apierrors.Error
+	if errors.As(err, &apiError) {
+		return apiError.Status, errorResponse{
+			Code:       apiError.Code,
+			Message:    apiError.Message,
+			RetryAfter: int(math.Ceil(apiError.RetryAfter.Seconds())),
+		}
+	}
+
+	var rateLimited *spotify.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		return http.StatusTooManyRequests, errorResponse{
+			Code:       "rate_limited",
+			Message:    "Too many requests to Spotify, please try again later",
+			RetryAfter: int(math.Ceil(rateLimited.RetryAfter.Seconds())),
+		}
+	}
+
+	for _, domainError := range domainErrors {
+		if errors.Is(err, domainError.err) {
+			message := domainError.message
+			if message == "" {
+				message = domainError.err.Error()
+			}
+
+			return domainError.status, errorResponse{Code: domainError.code, Message: message}
+		}
+	}
+
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		code, ok := statusCodes[httpError.Code]
+		if !ok {
+			code = "error"
+		}
+
+		return httpError.Code, errorResponse{Code: code, Message: fmt.Sprint(httpError.Message)}
+	}
+
+	return http.StatusInternalServerError, errorResponse{Code: "internal_error", Message: "Internal server error"}
+}
@@ -0,0 +1,445 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/nowplaying"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+	"github.com/labstack/echo/v4"
+)
+
+type GameController struct {
+	gameService        *services.GameService
+	releaseYearService *services.ReleaseYearService
+	spotify            *spotify.Spotify
+	poller             *nowplaying.Poller
+}
+
+func NewGameController(
+	gameService *services.GameService,
+	releaseYearService *services.ReleaseYearService,
+	spotify *spotify.Spotify,
+	poller *nowplaying.Poller,
+) *GameController {
+	return &GameController{gameService: gameService, releaseYearService: releaseYearService, spotify: spotify, poller: poller}
+}
+
+func (g *GameController) GetGames(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	games, err := g.gameService.FindGames(user)
+	if err != nil {
+		return fmt.Errorf("failed to get games: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, games)
+}
+
+func (g *GameController) CreateGame(c echo.Context) error {
+	type createGameRequest struct {
+		PlaylistID  string `json:"playlist_id"`
+		Mode        string `json:"mode,omitempty"`
+		Playback    string `json:"playback,omitempty"`
+		MaxRounds   int    `json:"max_rounds,omitempty"`
+		TargetCards int    `json:"target_cards,omitempty"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	var req createGameRequest
+	if err := c.Bind(&req); err != nil || req.PlaylistID == "" {
+		return apierrors.BadRequest("playlist_id is required")
+	}
+
+	game, err := g.gameService.CreateGame(user, services.GameSettings{
+		PlaylistID:  req.PlaylistID,
+		Mode:        req.Mode,
+		Playback:    req.Playback,
+		MaxRounds:   req.MaxRounds,
+		TargetCards: req.TargetCards,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, redactGame(game))
+}
+
+func (g *GameController) GetGame(c echo.Context) error {
+	game, err := g.findGame(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, redactGame(game))
+}
+
+func (g *GameController) AddPlayer(c echo.Context) error {
+	type addPlayerRequest struct {
+		Name string `json:"name"`
+	}
+
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	var req addPlayerRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	player, err := g.gameService.AddPlayer(game, req.Name)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, player)
+}
+
+// RemovePlayer lets the host kick a player or a player leave the game.
+func (g *GameController) RemovePlayer(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findGame(c)
+	if err != nil {
+		return err
+	}
+
+	playerID, err := strconv.ParseUint(c.Param("playerId"), 10, 64)
+	if err != nil {
+		return services.ErrPlayerNotFound
+	}
+
+	if err := g.gameService.RemovePlayer(user, game, uint(playerID)); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// joinCodeResponse is the code other users join the game with from the lobby.
+type joinCodeResponse struct {
+	JoinCode  string    `json:"joinCode"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CreateJoinCode hands out a new join code for the lobby. Previous codes stop working, e.g. to keep
+// kicked players from joining again.
+func (g *GameController) CreateJoinCode(c echo.Context) error {
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	if err := g.gameService.CreateJoinCode(game); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, joinCodeResponse{JoinCode: game.JoinCode, ExpiresAt: *game.JoinCodeExpiresAt})
+}
+
+// JoinGame adds the user to the game of the join code. It is safe to retry, users who have joined
+// already get their player back.
+func (g *GameController) JoinGame(c echo.Context) error {
+	type joinGameRequest struct {
+		Code     string `json:"code"`
+		Nickname string `json:"nickname"`
+	}
+
+	type joinGameResponse struct {
+		Game   *models.Game   `json:"game"`
+		Player *models.Player `json:"player"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	var req joinGameRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return apierrors.BadRequest("code is required")
+	}
+
+	game, player, err := g.gameService.JoinGame(user, req.Code, req.Nickname)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, joinGameResponse{Game: redactGame(game), Player: player})
+}
+
+// SetReady lets a player tell the lobby whether they are ready for the game to start.
+func (g *GameController) SetReady(c echo.Context) error {
+	type readyRequest struct {
+		Ready bool `json:"ready"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findGame(c)
+	if err != nil {
+		return err
+	}
+
+	playerID, err := strconv.ParseUint(c.Param("playerId"), 10, 64)
+	if err != nil {
+		return services.ErrPlayerNotFound
+	}
+
+	var req readyRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	player, err := g.gameService.SetReady(user, game, uint(playerID), req.Ready)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, player)
+}
+
+// HandOffHost makes another player the host of the game, whose Spotify account is used for playback from now on.
+func (g *GameController) HandOffHost(c echo.Context) error {
+	type handOffRequest struct {
+		PlayerID uint `json:"player_id"`
+	}
+
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	var req handOffRequest
+	if err := c.Bind(&req); err != nil || req.PlayerID == 0 {
+		return apierrors.BadRequest("player_id is required")
+	}
+
+	previousHost := game.UserID
+
+	if _, err := g.gameService.HandOffHost(game, req.PlayerID); err != nil {
+		return err
+	}
+
+	// playback changes are published from the new host's account from now on
+	g.poller.Unwatch(previousHost, game.ID)
+	if err := g.poller.Watch(game); err != nil {
+		slog.Warn("Failed to watch playback of game", "game", game.ID, "error", err)
+	}
+
+	return c.JSON(http.StatusOK, redactGame(game))
+}
+
+func (g *GameController) StartRound(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	playlist, err := g.spotify.GetPlaylist(c.Request().Context(), user, game.PlaylistID)
+	if err != nil {
+		return err
+	}
+
+	tracks := playlist.GameTracks()
+	g.releaseYearService.Enrich(tracks)
+
+	round, err := g.gameService.StartRound(game, tracks)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, round.Redacted())
+}
+
+// hostPlaybackResponse tells the host's app which track to play in games with host_device playback.
+type hostPlaybackResponse struct {
+	TrackID  string `json:"trackId"`
+	TrackURI string `json:"trackUri"`
+	TrackURL string `json:"trackUrl"`
+}
+
+func (g *GameController) Play(c echo.Context) error {
+	type playRequest struct {
+		DeviceID string `json:"device_id,omitempty"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	var req playRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	round := game.CurrentRound()
+	if round == nil || round.Status != models.RoundStatusPlaying {
+		return services.ErrNoRoundPlaying
+	}
+
+	// the host's app plays the track itself, e.g. because the host only has Spotify Free
+	if game.Playback == models.GamePlaybackHostDevice {
+		return c.JSON(http.StatusOK, hostPlaybackResponse{
+			TrackID:  round.TrackID,
+			TrackURI: "spotify:track:" + round.TrackID,
+			TrackURL: "https://open.spotify.com/track/" + round.TrackID,
+		})
+	}
+
+	if err := g.spotify.PlayTrack(c.Request().Context(), user, req.DeviceID, round.TrackID); err != nil {
+		return err
+	}
+
+	g.poller.Refresh(game.UserID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Playback returns the playback state of the game's host without the track, so players can follow along
+// without being able to look it up.
+func (g *GameController) Playback(c echo.Context) error {
+	game, err := g.findGame(c)
+	if err != nil {
+		return err
+	}
+
+	state, err := g.poller.GetHost(game)
+	if err != nil {
+		return err
+	}
+
+	if err := g.poller.Watch(game); err != nil {
+		slog.Warn("Failed to watch playback of game", "game", game.ID, "error", err)
+	}
+
+	return c.JSON(http.StatusOK, events.PlaybackData{
+		IsPlaying:  state.IsPlaying,
+		ProgressMs: state.ProgressMs,
+		DurationMs: state.Item.DurationMs,
+	})
+}
+
+// Pause pauses the track of the current round. In host_device games the host's app has paused it already.
+// Either way, the poller picks up the pause right away and tells the players about it.
+func (g *GameController) Pause(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	if game.Playback != models.GamePlaybackHostDevice {
+		if err := g.spotify.Pause(c.Request().Context(), user); err != nil {
+			return err
+		}
+	}
+
+	g.poller.Refresh(game.UserID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (g *GameController) SubmitGuess(c echo.Context) error {
+	type guessRequest struct {
+		PlayerID uint `json:"player_id"`
+		Year     int  `json:"year,omitempty"`
+		Position *int `json:"position,omitempty"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findGame(c)
+	if err != nil {
+		return err
+	}
+
+	var req guessRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	guess, err := g.gameService.SubmitGuess(user, game, req.PlayerID, req.Year, req.Position)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, guess)
+}
+
+func (g *GameController) Reveal(c echo.Context) error {
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := g.gameService.RevealRound(game); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, redactGame(game))
+}
+
+func (g *GameController) Finish(c echo.Context) error {
+	game, err := g.findHostedGame(c)
+	if err != nil {
+		return err
+	}
+
+	if err := g.gameService.FinishGame(game); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, redactGame(game))
+}
+
+func (g *GameController) findGame(c echo.Context) (*models.Game, error) {
+	user := c.Get("user").(*models.User)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, services.ErrGameNotFound
+	}
+
+	return g.gameService.FindGame(user, uint(id))
+}
+
+// findHostedGame returns the game like findGame, but only to its host.
+func (g *GameController) findHostedGame(c echo.Context) (*models.Game, error) {
+	user := c.Get("user").(*models.User)
+
+	game, err := g.findGame(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if !game.IsHost(user.ID) {
+		return nil, services.ErrNotGameHost
+	}
+
+	return game, nil
+}
+
+// redactGame hides the track of a round that is still playing.
+func redactGame(game *models.Game) *models.Game {
+	redacted := *game
+	redacted.Rounds = make([]models.Round, len(game.Rounds))
+	for i, round := range game.Rounds {
+		redacted.Rounds[i] = round.Redacted()
+	}
+
+	return &redacted
+}
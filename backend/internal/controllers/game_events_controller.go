@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/nowplaying"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// heartbeatInterval is how often idle connections get a heartbeat. The API token is checked again
+	// each time, so connections don't outlive revoked or expired tokens.
+	heartbeatInterval = 25 * time.Second
+	// clientTimeout is how long a WebSocket client may stay silent before its connection is closed.
+	// Clients are expected to answer heartbeats with one of their own.
+	clientTimeout = 2*heartbeatInterval + 10*time.Second
+	// authTimeout is how long a client without an Authorization header has to send its auth message.
+	authTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+	// streamRetry tells EventSource clients how long to wait before reconnecting.
+	streamRetry = 3 * time.Second
+)
+
+// clientMessage is sent by WebSocket clients, either {"type": "auth", "token": "..."} to authenticate
+// a connection or {"type": "heartbeat"} to keep it open.
+type clientMessage struct {
+	Type  events.Type `json:"type"`
+	Token string      `json:"token,omitempty"`
+}
+
+// socketError is sent before the connection is closed because of an error.
+type socketError struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type GameEventsController struct {
+	gameService     *services.GameService
+	apiTokenService *services.APITokenService
+	poller          *nowplaying.Poller
+}
+
+func NewGameEventsController(
+	gameService *services.GameService,
+	apiTokenService *services.APITokenService,
+	poller *nowplaying.Poller,
+) *GameEventsController {
+	return &GameEventsController{gameService: gameService, apiTokenService: apiTokenService, poller: poller}
+}
+
+// WebSocket pushes the events of a game to the client. The API token is either given in the Authorization
+// header or, as browsers can't set headers on WebSocket connections, in the first message.
+func (g *GameEventsController) WebSocket(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return services.ErrGameNotFound
+	}
+
+	lastEventID, err := parseLastEventID(c)
+	if err != nil {
+		return err
+	}
+
+	token := c.Request().Header.Get("Authorization")
+	if token != "" && !strings.HasPrefix(token, "Bearer ") {
+		return apierrors.ErrUnauthorized
+	}
+
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	// fail before the upgrade if the client has sent a token
+	if token != "" {
+		if _, _, err := g.authorize(token, uint(id)); err != nil {
+			return err
+		}
+	}
+
+	server := websocket.Server{
+		// connections are authenticated by API token, not by cookies, so any origin is fine
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			g.serve(ws, uint(id), token, lastEventID)
+		},
+	}
+
+	server.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+func (g *GameEventsController) serve(ws *websocket.Conn, gameID uint, plaintext string, lastEventID uint64) {
+	if plaintext == "" {
+		var message clientMessage
+
+		_ = ws.SetReadDeadline(time.Now().Add(authTimeout))
+		if err := websocket.JSON.Receive(ws, &message); err != nil || message.Type != "auth" || message.Token == "" {
+			sendSocketError(ws, apierrors.ErrUnauthorized)
+			return
+		}
+
+		plaintext = message.Token
+	}
+
+	game, token, err := g.authorize(plaintext, gameID)
+	if err != nil {
+		sendSocketError(ws, err)
+		return
+	}
+
+	subscription, missed := g.subscribe(game, lastEventID)
+	defer subscription.Close()
+
+	for _, event := range missed {
+		if err := sendSocketMessage(ws, event); err != nil {
+			return
+		}
+	}
+
+	// the client has to send something every now and then, otherwise the connection is considered dead
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		for {
+			var message clientMessage
+
+			_ = ws.SetReadDeadline(time.Now().Add(clientTimeout))
+			if err := websocket.JSON.Receive(ws, &message); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				// the client couldn't keep up, it has to reconnect with the ID of the last event it has received
+				return
+			}
+
+			if err := sendSocketMessage(ws, event); err != nil {
+				return
+			}
+
+			if hasLeft(event, token.UserID) {
+				return
+			}
+
+		case <-heartbeat.C:
+			if err := g.checkToken(token); err != nil {
+				sendSocketError(ws, err)
+				return
+			}
+
+			if err := sendSocketMessage(ws, events.Event{Type: events.Heartbeat, Time: time.Now()}); err != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Stream sends the events of a game as Server-Sent Events, for networks that block WebSocket upgrades.
+// EventSource passes the ID of the last event it has received in the Last-Event-ID header when it reconnects.
+func (g *GameEventsController) Stream(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+	token := c.Get("apiToken").(*models.APIToken)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return services.ErrGameNotFound
+	}
+
+	lastEventID, err := parseLastEventID(c)
+	if err != nil {
+		return err
+	}
+
+	game, err := g.gameService.FindGame(user, uint(id))
+	if err != nil {
+		return err
+	}
+
+	subscription, missed := g.subscribe(game, lastEventID)
+	defer subscription.Close()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	// keeps reverse proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds()); err != nil {
+		return nil
+	}
+
+	for _, event := range missed {
+		if err := writeStreamEvent(w, event); err != nil {
+			return nil
+		}
+	}
+
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				// EventSource reconnects on its own and resumes with the last event it has received
+				return nil
+			}
+
+			if err := writeStreamEvent(w, event); err != nil {
+				return nil
+			}
+
+			if hasLeft(event, user.ID) {
+				w.Flush()
+				return nil
+			}
+
+		case <-heartbeat.C:
+			if err := g.checkToken(token); err != nil {
+				writeStreamError(w, err)
+				return nil
+			}
+
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+
+		case <-c.Request().Context().Done():
+			return nil
+		}
+
+		w.Flush()
+	}
+}
+
+// subscribe subscribes to the events of the game, including the playback events of its host.
+func (g *GameEventsController) subscribe(game *models.Game, lastEventID uint64) (*events.Subscription, []events.Event) {
+	subscription, missed := g.gameService.Subscribe(game, lastEventID)
+
+	if err := g.poller.Watch(game); err != nil {
+		slog.Warn("Failed to watch playback of game", "game", game.ID, "error", err)
+	}
+
+	return subscription, missed
+}
+
+// authorize returns the game if the token belongs to a user who may access it.
+func (g *GameEventsController) authorize(plaintext string, gameID uint) (*models.Game, *models.APIToken, error) {
+	user, token, err := g.apiTokenService.Authenticate(plaintext)
+	if err != nil {
+		if !errors.Is(err, services.ErrInvalidAPIToken) {
+			slog.Error("Failed to find user by API token", "error", err)
+		}
+
+		return nil, nil, apierrors.ErrUnauthorized
+	}
+
+	game, err := g.gameService.FindGame(user, gameID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return game, token, nil
+}
+
+func (g *GameEventsController) checkToken(token *models.APIToken) error {
+	if err := g.apiTokenService.CheckToken(token); err != nil {
+		if !errors.Is(err, services.ErrInvalidAPIToken) {
+			return err
+		}
+
+		return apierrors.ErrUnauthorized
+	}
+
+	return nil
+}
+
+// hasLeft reports whether the event tells that the user has left the game or has been kicked, so their
+// connection is closed after it has been delivered.
+func hasLeft(event events.Event, userID uint) bool {
+	data, ok := event.Data.(events.PlayerData)
+
+	return ok && event.Type == events.PlayerLeft && data.Player.UserID != nil && *data.Player.UserID == userID
+}
+
+// parseLastEventID returns the ID of the last event a reconnecting client has received, either from the
+// Last-Event-ID header or from the lastEventId query parameter, as browsers can't set headers on WebSocket
+// connections. It is 0 for new clients.
+func parseLastEventID(c echo.Context) (uint64, error) {
+	value := c.Request().Header.Get("Last-Event-ID")
+	if value == "" {
+		value = c.QueryParam("lastEventId")
+	}
+
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, apierrors.BadRequest("Invalid last event ID")
+	}
+
+	return id, nil
+}
+
+func sendSocketMessage(ws *websocket.Conn, message any) error {
+	_ = ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	return websocket.JSON.Send(ws, message)
+}
+
+func sendSocketError(ws *websocket.Conn, err error) {
+	_ = sendSocketMessage(ws, newSocketError(err))
+}
+
+func newSocketError(err error) socketError {
+	status, response := errorToResponse(err)
+	if status >= http.StatusInternalServerError {
+		slog.Error("Event connection failed", "error", err)
+	}
+
+	return socketError{Type: "error", Code: response.Code, Message: response.Message}
+}
+
+// writeStreamEvent writes the event in the text/event-stream format. Events without ID, like Reset,
+// don't change the ID EventSource resumes from.
+func writeStreamEvent(w *echo.Response, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if event.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.ID); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+
+	return err
+}
+
+func writeStreamError(w *echo.Response, err error) {
+	data, err := json.Marshal(newSocketError(err))
+	if err != nil {
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+}
@@ -1,120 +1,295 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
 	"github.com/domnikl/music-box-game/backend/internal/crypto"
 	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/nowplaying"
 	"github.com/domnikl/music-box-game/backend/internal/services"
 	"github.com/domnikl/music-box-game/backend/internal/spotify"
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	// authSessionName is the session binding an authorization to the browser it has been started in
+	authSessionName = "spotify_auth"
+	// authSessionMaxAge matches how long the OAuth state is valid, in seconds
+	authSessionMaxAge = 15 * 60
+)
+
 type SpotifyController struct {
-	userService *services.UserService
-	spotify     *spotify.Spotify
+	userService        *services.UserService
+	loginTicketService *services.LoginTicketService
+	spotify            *spotify.Spotify
+	poller             *nowplaying.Poller
 }
 
-func NewSpotifyController(userService *services.UserService, spotify *spotify.Spotify) *SpotifyController {
-	return &SpotifyController{userService: userService, spotify: spotify}
+func NewSpotifyController(
+	userService *services.UserService,
+	loginTicketService *services.LoginTicketService,
+	spotify *spotify.Spotify,
+	poller *nowplaying.Poller,
+) *SpotifyController {
+	return &SpotifyController{userService: userService, loginTicketService: loginTicketService, spotify: spotify, poller: poller}
 }
 
-func (s *SpotifyController) Auth(c echo.Context) error {
+// CreateLoginTicket returns a ticket for the app to open /spotify/auth with in the browser, so the
+// API token never leaves the app. With a redirect URI, the browser returns to the app when done.
+func (s *SpotifyController) CreateLoginTicket(c echo.Context) error {
+	type loginTicketRequest struct {
+		RedirectURI string `json:"redirectUri"`
+	}
+
+	type loginTicketResponse struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expiresAt"`
+		AuthPath  string    `json:"authPath"`
+	}
+
 	user := c.Get("user").(*models.User)
-	state := fmt.Sprintf("%s:%s", crypto.RandomAlphaNumericString(32), user.APIToken)
-	url := s.spotify.AuthURL(state)
 
-	sess, err := session.Get("session", c)
+	var req loginTicketRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	ticket, plaintext, err := s.loginTicketService.CreateTicket(user, req.RedirectURI)
+	if err != nil {
+		return fmt.Errorf("failed to create login ticket: %w", err)
+	}
+
+	return c.JSON(http.StatusCreated, loginTicketResponse{
+		Ticket:    plaintext,
+		ExpiresAt: ticket.ExpiresAt,
+		AuthPath:  "/spotify/auth?ticket=" + url.QueryEscape(plaintext),
+	})
+}
+
+// Auth redirects to Spotify to link the account of the user the login ticket belongs to. The ticket
+// is traded for an OAuth state, which is also stored in a session, so only this browser can finish
+// the authorization.
+func (s *SpotifyController) Auth(c echo.Context) error {
+	state, verifier, err := s.loginTicketService.StartAuthorization(c.QueryParam("ticket"))
 	if err != nil {
-		slog.Error("Failed to save session: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   86400 * 7,
-		HttpOnly: true,
+
+	// a broken or expired cookie is simply replaced
+	sess, err := session.Get(authSessionName, c)
+	if sess == nil {
+		return fmt.Errorf("failed to get session: %w", err)
 	}
-	sess.Values["state"] = state
 
+	sess.Options.MaxAge = authSessionMaxAge
+	sess.Values["state"] = state
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		slog.Error("Failed to save session: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return fmt.Errorf("failed to save session: %w", err)
 	}
 
-	return c.Redirect(http.StatusFound, url)
+	return c.Redirect(http.StatusFound, s.spotify.AuthURL(state, verifier))
 }
 
+// Callback links Spotify with the tokens Spotify authorized. If the authorization has a redirect URI,
+// the browser is sent back to the app with status=success or status=error and an error code.
 func (s *SpotifyController) Callback(c echo.Context) error {
 	code := c.QueryParam("code")
 	state := c.QueryParam("state")
 
-	sess, err := session.Get("session", c)
+	// an authorization link started by someone else must not link the Spotify account of this browser
+	if !s.authSessionMatches(c, state) {
+		return services.ErrInvalidOAuthState
+	}
+
+	oauthState, user, err := s.loginTicketService.CompleteAuthorization(state)
 	if err != nil {
-		slog.Error("Failed to get session: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
-	sessionState, ok := sess.Values["state"].(string)
-	if !ok || state != sessionState {
-		slog.Error("State mismatch: " + state + " != " + sessionState)
-		return c.String(http.StatusBadRequest, "State mismatch")
+	err = s.linkSpotify(c.Request().Context(), user, oauthState, code, c.QueryParam("error"))
+	if oauthState.RedirectURI == "" {
+		if err != nil {
+			return err
+		}
+
+		return c.String(http.StatusOK, "You can now close this window")
 	}
 
-	// clear state
-	sess.Values["state"] = nil
+	query := url.Values{"status": {"success"}}
+	if err != nil {
+		status, response := errorToResponse(err)
+		if status >= http.StatusInternalServerError {
+			slog.Error("Failed to link Spotify", "error", err, "user_id", user.ID)
+		}
+
+		query = url.Values{"status": {"error"}, "code": {response.Code}}
+	}
+
+	return c.Redirect(http.StatusFound, appendQuery(oauthState.RedirectURI, query))
+}
+
+// authSessionMatches tells whether the authorization with the state has been started in the browser
+// of the request. The session is deleted either way, it is only good for a single attempt.
+func (s *SpotifyController) authSessionMatches(c echo.Context, state string) bool {
+	sess, err := session.Get(authSessionName, c)
+	if err != nil {
+		return false
+	}
+
+	expected, ok := sess.Values["state"].(string)
+
+	sess.Options.MaxAge = -1
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		slog.Error("Failed to saved session: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		slog.Error("Failed to delete session: " + err.Error())
+	}
+
+	return ok && state != "" && crypto.Equal(expected, state)
+}
+
+// linkSpotify exchanges the authorization code and stores the tokens. spotifyError is the error
+// Spotify redirected with instead of a code, e.g. access_denied if the user cancelled.
+func (s *SpotifyController) linkSpotify(ctx context.Context, user *models.User, oauthState *models.OAuthState, code, spotifyError string) error {
+	switch {
+	case spotifyError == "access_denied":
+		return apierrors.New(http.StatusForbidden, "access_denied", "Spotify authorization has been denied")
+	case spotifyError != "":
+		return apierrors.New(http.StatusBadGateway, "spotify_authorization_failed", "Spotify authorization failed: "+spotifyError)
+	case code == "":
+		return apierrors.BadRequest("Missing authorization code")
+	}
+
+	t, err := s.spotify.Exchange(ctx, code, oauthState.CodeVerifier)
+	if err != nil {
+		return fmt.Errorf("failed to exchange code for token: %w", err)
+	}
+
+	// the profile is read before anything is stored, the tokens must not end up with the user if the
+	// account has been linked by another one
+	authorized := *user
+	authorized.SpotifyToken = t.AccessToken
+	authorized.SpotifyRefreshToken = t.RefreshToken
+	authorized.SpotifyTokenExpiresAt = &t.Expiry
+
+	profile, err := s.spotify.GetProfile(ctx, &authorized)
+	if err != nil {
+		return err
+	}
+
+	return s.userService.LinkSpotifyAccount(user, t.AccessToken, t.RefreshToken, t.Expiry, profile.SpotifyProfile())
+}
+
+// Unlink removes the Spotify tokens of the user, it has to link Spotify again to play.
+func (s *SpotifyController) Unlink(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	if err := s.userService.UnlinkSpotify(user); err != nil {
+		return fmt.Errorf("failed to unlink Spotify: %w", err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetMergeRequests lists the users waiting to be merged into the user because they have linked its
+// Spotify account on another device.
+func (s *SpotifyController) GetMergeRequests(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	requests, err := s.userService.MergeRequests(user)
+	if err != nil {
+		return fmt.Errorf("failed to get merge requests: %w", err)
 	}
 
-	t, err := s.spotify.Exchange(code)
+	return c.JSON(http.StatusOK, requests)
+}
+
+// AcceptMergeRequest merges the user that has raised the request into the user. Its device is logged in
+// as the user afterwards.
+func (s *SpotifyController) AcceptMergeRequest(c echo.Context) error {
+	user := c.Get("user").(*models.User)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
-		slog.Error("Failed to exchange code for token: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return apierrors.BadRequest("Invalid merge request ID")
+	}
+
+	if err := s.userService.AcceptMergeRequest(user, uint(id)); err != nil {
+		return err
 	}
 
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *SpotifyController) DeclineMergeRequest(c echo.Context) error {
 	user := c.Get("user").(*models.User)
-	user.SpotifyToken = t.AccessToken
-	user.SpotifyRefreshToken = t.RefreshToken
 
-	err = s.userService.UpdateUser(user)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return apierrors.BadRequest("Invalid merge request ID")
+	}
+
+	if err := s.userService.DeclineMergeRequest(user, uint(id)); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// appendQuery adds the values to the query of the URI, keeping the query it already has.
+func appendQuery(uri string, values url.Values) string {
+	parsed, err := url.Parse(uri)
 	if err != nil {
-		slog.Error("Failed to update user: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return uri
+	}
+
+	query := parsed.Query()
+	for key, value := range values {
+		query[key] = value
 	}
 
-	return c.String(http.StatusOK, "You can now close this window")
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
 }
 
 func (s *SpotifyController) GetPlaylist(c echo.Context) error {
 	id := c.Param("id")
 	user := c.Get("user").(*models.User)
 
-	playlist, err := s.spotify.GetPlaylist(user, id)
+	playlist, err := s.spotify.GetPlaylist(c.Request().Context(), user, id)
 
 	if err != nil {
-		slog.Error("Failed to get playlist: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
 	return c.JSON(http.StatusOK, playlist)
 }
 
 func (s *SpotifyController) GetPlaylists(c echo.Context) error {
+	type playlistsResponse struct {
+		Items          []spotify.Item `json:"items"`
+		Total          int            `json:"total"`
+		Limit          int            `json:"limit"`
+		Offset         int            `json:"offset"`
+		NextOffset     *int           `json:"nextOffset"`
+		PreviousOffset *int           `json:"previousOffset"`
+	}
+
 	queryLimit := c.QueryParam("limit")
 	if queryLimit == "" {
 		queryLimit = "50"
 	}
 
-	limit, err := strconv.Atoi(c.QueryParam("limit"))
-	if err != nil {
-		slog.Error("Failed to parse limit: " + err.Error())
-		return c.String(http.StatusBadRequest, "Invalid limit")
+	limit, err := strconv.Atoi(queryLimit)
+	if err != nil || limit < 1 || limit > 50 {
+		return apierrors.BadRequest("Invalid limit")
 	}
 
 	queryOffset := c.QueryParam("offset")
@@ -123,43 +298,60 @@ func (s *SpotifyController) GetPlaylists(c echo.Context) error {
 	}
 
 	offset, err := strconv.Atoi(queryOffset)
-	if err != nil {
-		slog.Error("Failed to parse offset: " + err.Error())
-		return c.String(http.StatusBadRequest, "Invalid offset")
+	if err != nil || offset < 0 {
+		return apierrors.BadRequest("Invalid offset")
 	}
 
 	user := c.Get("user").(*models.User)
-	playlists, err := s.spotify.GetPlaylists(user, limit, offset)
+	playlists, err := s.spotify.GetPlaylists(c.Request().Context(), user, limit, offset)
 
 	if err != nil {
-		slog.Error("Failed to get playlists: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
+	}
+
+	response := playlistsResponse{
+		Items:  playlists.Items,
+		Total:  playlists.Total,
+		Limit:  playlists.Limit,
+		Offset: playlists.Offset,
 	}
 
-	return c.JSON(http.StatusOK, playlists)
+	if playlists.Next != "" {
+		next := playlists.Offset + playlists.Limit
+		response.NextOffset = &next
+	}
+
+	if playlists.Previous != "" {
+		previous := max(playlists.Offset-playlists.Limit, 0)
+		response.PreviousOffset = &previous
+	}
+
+	return c.JSON(http.StatusOK, response)
 }
 
 func (s *SpotifyController) Next(c echo.Context) error {
 	user := c.Get("user").(*models.User)
-	err := s.spotify.Next(user)
+	err := s.spotify.Next(c.Request().Context(), user)
 
 	if err != nil {
-		slog.Error("Failed to skip track: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
+	s.poller.Refresh(user.ID)
+
 	return c.NoContent(http.StatusNoContent)
 }
 
 func (s *SpotifyController) Pause(c echo.Context) error {
 	user := c.Get("user").(*models.User)
-	err := s.spotify.Pause(user)
+	err := s.spotify.Pause(c.Request().Context(), user)
 
 	if err != nil {
-		slog.Error("Failed to pause playback: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
+	s.poller.Refresh(user.ID)
+
 	return c.NoContent(http.StatusNoContent)
 }
 
@@ -173,41 +365,78 @@ func (s *SpotifyController) Play(c echo.Context) error {
 
 	var req playRequest
 	if err := c.Bind(&req); err != nil {
-		slog.Error("Failed to bind request: " + err.Error())
-		return c.String(http.StatusBadRequest, "Invalid request")
+		return apierrors.BadRequest("Invalid request")
 	}
 
-	err := s.spotify.Play(user, req.DeviceID, req.PlaylistID)
+	err := s.spotify.Play(c.Request().Context(), user, req.DeviceID, req.PlaylistID)
 
 	if err != nil {
-		slog.Error("Failed to start playback: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
+	s.poller.Refresh(user.ID)
+
 	return c.NoContent(http.StatusNoContent)
 }
 
+// GetProfile refreshes and returns the profile of the linked Spotify account. Premium tells the app
+// whether the user can control playback or has to fall back to playing on the host's device.
+func (s *SpotifyController) GetProfile(c echo.Context) error {
+	type profileResponse struct {
+		models.SpotifyProfile
+		Premium bool `json:"premium"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	if err := s.spotify.RefreshProfile(c.Request().Context(), user); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, profileResponse{user.SpotifyProfile, user.SpotifyPremium()})
+}
+
 func (s *SpotifyController) GetDevices(c echo.Context) error {
 	user := c.Get("user").(*models.User)
 
-	devices, err := s.spotify.GetDevices(user)
+	devices, err := s.spotify.GetDevices(c.Request().Context(), user)
 
 	if err != nil {
-		slog.Error("Failed to get devices: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
 	return c.JSON(http.StatusOK, devices)
 }
 
+// SetPreferredDevice stores the device playback is transferred to if no device is active.
+// An empty device_id removes the preference.
+func (s *SpotifyController) SetPreferredDevice(c echo.Context) error {
+	type preferredDeviceRequest struct {
+		DeviceID string `json:"device_id"`
+	}
+
+	user := c.Get("user").(*models.User)
+
+	var req preferredDeviceRequest
+	if err := c.Bind(&req); err != nil {
+		return apierrors.BadRequest("Invalid request")
+	}
+
+	if err := s.userService.SetPreferredDevice(user, req.DeviceID); err != nil {
+		return fmt.Errorf("failed to update preferred device: %w", err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 func (s *SpotifyController) GetCurrentlyPlaying(c echo.Context) error {
 	user := c.Get("user").(*models.User)
 
-	currentlyPlaying, err := s.spotify.GetCurrentlyPlaying(user)
+	// every phone in a game asks for the same host, so the answer is taken from the shared poller
+	currentlyPlaying, err := s.poller.Get(user)
 
 	if err != nil {
-		slog.Error("Failed to get currently playing: " + err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
 	return c.JSON(http.StatusOK, currentlyPlaying)
@@ -1,20 +1,107 @@
+// Package crypto generates secrets like API tokens and OAuth states. All randomness comes from crypto/rand.
 package crypto
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
 )
 
-var seededRand *rand.Rand = rand.New(rand.NewSource(int64(time.Now().UnixNano())))
+const (
+	AlphaNumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
-func StringWithCharset(length int, charset string) string {
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+	// APITokenPrefix identifies API tokens handed out to the app, so they can be recognized in logs or by secret scanners.
+	APITokenPrefix = "mbg_live_"
+
+	apiTokenLength = 48
+
+	minSecretLength     = 32
+	minSecretCharacters = 12
+)
+
+// StringWithCharset returns a random string of the given length with characters from charset. Every character
+// of the charset is equally likely: random bytes that would favor some characters over others are discarded.
+func StringWithCharset(length int, charset string) (string, error) {
+	if len(charset) == 0 || len(charset) > 256 {
+		return "", errors.New("charset must contain between 1 and 256 characters")
+	}
+
+	// the largest multiple of len(charset) that fits into a byte, bytes above it are rejected
+	limit := 256 - 256%len(charset)
+
+	b := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(b) < length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to read random bytes: %w", err)
+		}
+
+		for _, r := range buf {
+			if int(r) >= limit {
+				continue
+			}
+
+			b = append(b, charset[int(r)%len(charset)])
+			if len(b) == length {
+				break
+			}
+		}
+	}
+
+	return string(b), nil
+}
+
+func RandomAlphaNumericString(length int) (string, error) {
+	return StringWithCharset(length, AlphaNumeric)
+}
+
+// URLSafeToken returns n random bytes encoded as unpadded base64url, which can be used in URLs and headers as is.
+func URLSafeToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
 	}
-	return string(b)
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// PrefixedToken returns a random alphanumeric token of the given length behind prefix, e.g. "mbg_live_...".
+func PrefixedToken(prefix string, length int) (string, error) {
+	token, err := RandomAlphaNumericString(length)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + token, nil
+}
+
+// NewAPIToken returns a new API token for the app.
+func NewAPIToken() (string, error) {
+	return PrefixedToken(APITokenPrefix, apiTokenLength)
 }
 
-func RandomAlphaNumericString(length int) string {
-	return StringWithCharset(length, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+// Equal compares two secrets in constant time, so the time taken doesn't reveal how much of them matches.
+func Equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CheckSecret returns an error if the secret is too short or made of too few different characters
+// to be a randomly generated one.
+func CheckSecret(secret string) error {
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("secret must be at least %d characters long", minSecretLength)
+	}
+
+	characters := map[rune]bool{}
+	for _, r := range secret {
+		characters[r] = true
+	}
+
+	if len(characters) < minSecretCharacters {
+		return fmt.Errorf("secret must contain at least %d different characters", minSecretCharacters)
+	}
+
+	return nil
 }
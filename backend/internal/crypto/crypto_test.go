@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringWithCharsetRejectsInvalidCharsets(t *testing.T) {
+	for _, charset := range []string{"", strings.Repeat("a", 257)} {
+		if _, err := StringWithCharset(8, charset); err == nil {
+			t.Errorf("StringWithCharset() with a charset of %d characters succeeded", len(charset))
+		}
+	}
+}
+
+func TestStringWithCharset(t *testing.T) {
+	full := make([]byte, 256)
+	for i := range full {
+		full[i] = byte(i)
+	}
+
+	tests := []struct {
+		name    string
+		length  int
+		charset string
+	}{
+		{name: "empty", length: 0, charset: AlphaNumeric},
+		{name: "single character", length: 1, charset: AlphaNumeric},
+		{name: "alphanumeric", length: 100, charset: AlphaNumeric},
+		{name: "charset of one", length: 20, charset: "x"},
+		{name: "charset of 256", length: 64, charset: string(full)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := StringWithCharset(test.length, test.charset)
+			if err != nil {
+				t.Fatalf("StringWithCharset() error = %v", err)
+			}
+
+			if len(got) != test.length {
+				t.Errorf("StringWithCharset() returned %d characters, want %d", len(got), test.length)
+			}
+
+			for i := range len(got) {
+				if strings.IndexByte(test.charset, got[i]) < 0 {
+					t.Errorf("StringWithCharset() returned %q, which is not in the charset", got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStringWithCharsetIsUniform(t *testing.T) {
+	// 256 isn't a multiple of 3, so without rejecting bytes "a" would come up more often than the others
+	const charset, length = "abc", 30000
+
+	got, err := StringWithCharset(length, charset)
+	if err != nil {
+		t.Fatalf("StringWithCharset() error = %v", err)
+	}
+
+	for _, c := range charset {
+		if n := strings.Count(got, string(c)); n < length/3*9/10 || n > length/3*11/10 {
+			t.Errorf("%q occurs %d times in %d characters, want about %d", c, n, length, length/3)
+		}
+	}
+}
+
+func TestPrefixedToken(t *testing.T) {
+	token, err := PrefixedToken("test_", 16)
+	if err != nil {
+		t.Fatalf("PrefixedToken() error = %v", err)
+	}
+
+	secret, ok := strings.CutPrefix(token, "test_")
+	if !ok || len(secret) != 16 {
+		t.Fatalf("PrefixedToken() = %q, want test_ followed by 16 characters", token)
+	}
+
+	if strings.Trim(secret, AlphaNumeric) != "" {
+		t.Errorf("PrefixedToken() = %q, want an alphanumeric secret", token)
+	}
+}
+
+func TestNewAPIToken(t *testing.T) {
+	first, err := NewAPIToken()
+	if err != nil {
+		t.Fatalf("NewAPIToken() error = %v", err)
+	}
+
+	second, err := NewAPIToken()
+	if err != nil {
+		t.Fatalf("NewAPIToken() error = %v", err)
+	}
+
+	if !strings.HasPrefix(first, APITokenPrefix) || len(first) != len(APITokenPrefix)+apiTokenLength {
+		t.Errorf("NewAPIToken() = %q, want %s followed by %d characters", first, APITokenPrefix, apiTokenLength)
+	}
+
+	if first == second {
+		t.Error("NewAPIToken() returned the same token twice")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "secret", b: "secret", want: true},
+		{a: "", b: "", want: true},
+		{a: "secret", b: "secreT", want: false},
+		{a: "secret", b: "secret ", want: false},
+		{a: "secret", b: "", want: false},
+		{a: "", b: "secret", want: false},
+	}
+
+	for _, test := range tests {
+		if got := Equal(test.a, test.b); got != test.want {
+			t.Errorf("Equal(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const keyLength = 32
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// WrappedKey is a data key encrypted with the key of the keyring identified by KeyID.
+type WrappedKey struct {
+	KeyID      string
+	Ciphertext string
+}
+
+// Keyring holds the keys used for envelope encryption: secrets are encrypted with a random data key,
+// which is itself encrypted ("wrapped") with a key of the keyring. New data keys are always wrapped
+// with the primary key, the others are kept to unwrap data keys until they have been re-wrapped.
+type Keyring struct {
+	primaryID string
+	keys      map[string][]byte
+}
+
+func NewKeyring(primaryID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primaryID]; !ok {
+		return nil, fmt.Errorf("primary key %q is missing", primaryID)
+	}
+
+	for id, key := range keys {
+		if len(key) != keyLength {
+			return nil, fmt.Errorf("key %q must be %d bytes long", id, keyLength)
+		}
+	}
+
+	return &Keyring{primaryID: primaryID, keys: keys}, nil
+}
+
+// ParseKeyring reads a keyring from a comma or newline separated list of "id:base64key" entries.
+// The first key is the primary key.
+func ParseKeyring(spec string) (*Keyring, error) {
+	primaryID := ""
+	keys := map[string][]byte{}
+
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, errors.New("keys must be given as id:base64key")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("key %q is given twice", id)
+		}
+
+		if primaryID == "" {
+			primaryID = id
+		}
+
+		keys[id] = key
+	}
+
+	if primaryID == "" {
+		return nil, errors.New("no keys given")
+	}
+
+	return NewKeyring(primaryID, keys)
+}
+
+// ReadKeyringFile reads a keyring from a file in the format of ParseKeyring, one key per line.
+func ReadKeyringFile(path string) (*Keyring, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyring(string(content))
+}
+
+func (k *Keyring) PrimaryID() string {
+	return k.primaryID
+}
+
+// GenerateDataKey returns a new random data key along with the data key wrapped by the primary key.
+// The wrapped key can only be unwrapped with the same additional data, see Encrypt.
+func (k *Keyring) GenerateDataKey(additionalData []byte) ([]byte, WrappedKey, error) {
+	dataKey := make([]byte, keyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, WrappedKey{}, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+
+	wrapped, err := k.wrap(dataKey, additionalData)
+	if err != nil {
+		return nil, WrappedKey{}, err
+	}
+
+	return dataKey, wrapped, nil
+}
+
+func (k *Keyring) UnwrapDataKey(wrapped WrappedKey, additionalData []byte) ([]byte, error) {
+	key, ok := k.keys[wrapped.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, wrapped.KeyID)
+	}
+
+	dataKey, err := Decrypt(key, wrapped.Ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	return []byte(dataKey), nil
+}
+
+// Rewrap wraps the data key with the primary key. Data encrypted with it stays as it is.
+func (k *Keyring) Rewrap(wrapped WrappedKey, additionalData []byte) (WrappedKey, error) {
+	dataKey, err := k.UnwrapDataKey(wrapped, additionalData)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+
+	return k.wrap(dataKey, additionalData)
+}
+
+func (k *Keyring) wrap(dataKey, additionalData []byte) (WrappedKey, error) {
+	ciphertext, err := Encrypt(k.keys[k.primaryID], string(dataKey), additionalData)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+
+	return WrappedKey{KeyID: k.primaryID, Ciphertext: ciphertext}, nil
+}
+
+// Encrypt encrypts the plaintext with AES-GCM and returns the nonce and ciphertext encoded as base64.
+// The additional data isn't encrypted, but decryption fails unless the same is given again, which binds
+// the ciphertext to where it is stored: it can't be copied to another row or column.
+func Encrypt(key []byte, plaintext string, additionalData []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), additionalData)), nil
+}
+
+// Decrypt decrypts a value returned by Encrypt with the same additional data.
+func Decrypt(key []byte, encoded string, additionalData []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", errors.New("ciphertext is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+
+	keyring, err := NewKeyring("primary", map[string][]byte{"primary": bytes.Repeat([]byte{1}, keyLength)})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+
+	return keyring
+}
+
+func TestDecryptRequiresSameAdditionalData(t *testing.T) {
+	key := bytes.Repeat([]byte{2}, keyLength)
+
+	ciphertext, err := Encrypt(key, "token", []byte("users/1/spotify_token"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	if got, err := Decrypt(key, ciphertext, []byte("users/1/spotify_token")); err != nil || got != "token" {
+		t.Errorf("Decrypt() = %q, %v, want token", got, err)
+	}
+
+	for _, additionalData := range []string{"users/2/spotify_token", "users/1/spotify_refresh_token", ""} {
+		if _, err := Decrypt(key, ciphertext, []byte(additionalData)); err == nil {
+			t.Errorf("Decrypt() with additional data %q succeeded", additionalData)
+		}
+	}
+}
+
+func TestUnwrapDataKeyRequiresSameAdditionalData(t *testing.T) {
+	keyring := newTestKeyring(t)
+
+	dataKey, wrapped, err := keyring.GenerateDataKey([]byte("users/1/spotify_token_data_key"))
+	if err != nil {
+		t.Fatalf("GenerateDataKey() error = %v", err)
+	}
+
+	unwrapped, err := keyring.UnwrapDataKey(wrapped, []byte("users/1/spotify_token_data_key"))
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("UnwrapDataKey() = %x, %v, want %x", unwrapped, err, dataKey)
+	}
+
+	if _, err := keyring.UnwrapDataKey(wrapped, []byte("users/2/spotify_token_data_key")); err == nil {
+		t.Error("UnwrapDataKey() of another user's data key succeeded")
+	}
+
+	if _, err := keyring.Rewrap(wrapped, []byte("users/2/spotify_token_data_key")); err == nil {
+		t.Error("Rewrap() of another user's data key succeeded")
+	}
+}
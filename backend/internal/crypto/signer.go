@@ -0,0 +1,33 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// Signer signs messages with HMAC-SHA256, e.g. to hand out values that can be verified without storing them.
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) < MinTokenKeyLength {
+		return nil, errors.New("signing key must be at least 32 bytes long")
+	}
+
+	return &Signer{key: key}, nil
+}
+
+// Sign returns the signature of the message encoded as unpadded base64url.
+func (s *Signer) Sign(message string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(message))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Signer) Verify(message, signature string) bool {
+	return Equal(s.Sign(message), signature)
+}
@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	// minimum length of keys used to hash tokens and sign messages
+	MinTokenKeyLength = 32
+
+	lookupPrefixLength = 8
+)
+
+// TokenHasher derives what is stored about a token instead of the token itself: a keyed hash to verify it
+// and a short lookup prefix to find it. Without the key, a leaked hash can't be checked against guesses.
+type TokenHasher struct {
+	key []byte
+}
+
+func NewTokenHasher(key []byte) (*TokenHasher, error) {
+	if len(key) < MinTokenKeyLength {
+		return nil, errors.New("token hash key must be at least 32 bytes long")
+	}
+
+	return &TokenHasher{key: key}, nil
+}
+
+// Hash returns the hex encoded HMAC-SHA256 of the token.
+func (h *TokenHasher) Hash(token string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(token))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the token matches the given hash.
+func (h *TokenHasher) Verify(token, hash string) bool {
+	return Equal(h.Hash(token), hash)
+}
+
+// LookupPrefix returns the first characters of the random part of the token. They narrow down the
+// candidates for a token without revealing enough of it to be of use.
+func LookupPrefix(token string) string {
+	token = strings.TrimPrefix(token, APITokenPrefix)
+	if len(token) > lookupPrefixLength {
+		token = token[:lookupPrefixLength]
+	}
+
+	return token
+}
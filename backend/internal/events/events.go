@@ -0,0 +1,97 @@
+// Package events fans out what happens in a game to everyone connected to it, e.g. over WebSocket.
+package events
+
+import (
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+)
+
+type Type string
+
+const (
+	PlayerJoined   Type = "player_joined"
+	PlayerLeft     Type = "player_left"
+	PlayerReady    Type = "player_ready"
+	HostChanged    Type = "host_changed"
+	RoundStarted   Type = "round_started"
+	TrackRevealed  Type = "track_revealed"
+	GuessSubmitted Type = "guess_submitted"
+	ScoresUpdated  Type = "scores_updated"
+	// the host's playback is watched by the now-playing poller, which publishes the following events
+	TrackChanged    Type = "track_changed"
+	PlaybackPaused  Type = "playback_paused"
+	PlaybackResumed Type = "playback_resumed"
+	PlaybackSeeked  Type = "playback_seeked"
+
+	// Reset is sent to clients that have missed events, e.g. because they have been offline for too long.
+	// They have to reload the game. It is never published.
+	Reset Type = "reset"
+	// Heartbeat is sent by connections to tell idle clients they are still connected. It is never published.
+	Heartbeat Type = "heartbeat"
+)
+
+// Event is something that happened in a game. IDs increase with every event published by a hub, so
+// clients can tell which events they have already seen. Data is one of the *Data types below.
+type Event struct {
+	ID     uint64    `json:"id,omitempty"`
+	GameID uint      `json:"gameId,omitempty"`
+	Type   Type      `json:"type"`
+	Time   time.Time `json:"time"`
+	Data   any       `json:"data,omitempty"`
+}
+
+// PlayerData is the data of PlayerJoined, PlayerLeft and PlayerReady events. Kicked tells whether a
+// player has left or has been removed by the host.
+type PlayerData struct {
+	Player models.Player `json:"player"`
+	Kicked bool          `json:"kicked,omitempty"`
+}
+
+// HostData is the data of HostChanged events. PlayerID is the player the game has been handed off to.
+type HostData struct {
+	UserID   uint `json:"userId"`
+	PlayerID uint `json:"playerId"`
+}
+
+// RoundData is the data of RoundStarted and TrackRevealed events. The track of a started round is redacted.
+type RoundData struct {
+	Round models.Round `json:"round"`
+}
+
+// GuessData is the data of GuessSubmitted events. The guess itself is left out, so players can't copy it.
+type GuessData struct {
+	RoundID  uint `json:"roundId"`
+	PlayerID uint `json:"playerId"`
+}
+
+type Score struct {
+	PlayerID uint   `json:"playerId"`
+	Name     string `json:"name"`
+	Score    int    `json:"score"`
+}
+
+// ScoresData is the data of ScoresUpdated events, published after each round and when the game ends.
+type ScoresData struct {
+	Status   string  `json:"status"`
+	Scores   []Score `json:"scores"`
+	WinnerID *uint   `json:"winnerId,omitempty"`
+}
+
+// PlaybackData is the data of TrackChanged, PlaybackPaused, PlaybackResumed and PlaybackSeeked events.
+// The track itself is left out, so players can't look it up.
+type PlaybackData struct {
+	IsPlaying  bool `json:"isPlaying"`
+	ProgressMs int  `json:"progressMs"`
+	DurationMs int  `json:"durationMs"`
+}
+
+// NewScoresData returns the current scores of all players of the game.
+func NewScoresData(game *models.Game) ScoresData {
+	scores := make([]Score, 0, len(game.Players))
+	for _, player := range game.Players {
+		scores = append(scores, Score{PlayerID: player.ID, Name: player.Name, Score: player.Score})
+	}
+
+	return ScoresData{Status: game.Status, Scores: scores, WinnerID: game.WinnerID}
+}
@@ -0,0 +1,181 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// subscriptionBuffer is the number of events a subscriber may fall behind before it is dropped.
+	subscriptionBuffer = 64
+	// logSize is the number of recent events kept per game, so clients can resume after reconnecting.
+	logSize = 256
+	// logRetention is how long the log of a game is kept once nothing is happening and nobody is subscribed.
+	logRetention = time.Hour
+)
+
+// Hub fans out events published for a game to all of its subscribers within this process. The latest
+// events of each game are kept, so subscribers can pick up where they left off.
+type Hub struct {
+	mu     sync.Mutex
+	lastID uint64
+	games  map[uint]*topic
+}
+
+type topic struct {
+	subscribers map[*Subscription]struct{}
+	log         []Event
+	// truncatedAt is the ID of the newest event that isn't in the log anymore, or the last ID of the
+	// hub when the topic has been created. Clients that have seen less than that have missed events.
+	truncatedAt  uint64
+	lastActiveAt time.Time
+}
+
+func NewHub() *Hub {
+	// IDs start at the current time, so IDs handed out by a previous process are lower than any new one
+	// and clients resuming with such an ID are told they have missed events
+	return &Hub{lastID: uint64(time.Now().UnixMicro()), games: map[uint]*topic{}}
+}
+
+// Subscription receives the events of a single game until it is closed.
+type Subscription struct {
+	hub    *Hub
+	gameID uint
+	events chan Event
+	closed bool
+}
+
+// Events returns the channel events are delivered on. It is closed when the subscription is closed,
+// either by Close or by the hub because the subscriber couldn't keep up.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the delivery of events. It is safe to call it more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	s.hub.remove(s)
+}
+
+// Subscribe starts delivering the events of the game published from now on.
+func (h *Hub) Subscribe(gameID uint) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.subscribe(gameID)
+}
+
+// Resume starts delivering the events of the game and returns the events published after lastEventID.
+// It reports false if some of them are no longer available or lastEventID hasn't been handed out by
+// this hub, so the subscriber has to reload the game.
+func (h *Hub) Resume(gameID uint, lastEventID uint64) (*Subscription, []Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.subscribe(gameID)
+	t := h.games[gameID]
+
+	if lastEventID < t.truncatedAt || lastEventID > h.lastID {
+		return s, nil, false
+	}
+
+	var missed []Event
+	for _, event := range t.log {
+		if event.ID > lastEventID {
+			missed = append(missed, event)
+		}
+	}
+
+	return s, missed, true
+}
+
+// Publish sends an event to all subscribers of the game and returns it. Publish never blocks: subscribers
+// whose buffer is full are dropped, so they notice they have missed events and can reconnect.
+func (h *Hub) Publish(gameID uint, eventType Type, data any) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(gameID)
+
+	h.lastID++
+	event := Event{ID: h.lastID, GameID: gameID, Type: eventType, Time: time.Now(), Data: data}
+
+	if len(t.log) == logSize {
+		t.truncatedAt = t.log[0].ID
+		t.log = append(t.log[:0], t.log[1:]...)
+	}
+
+	t.log = append(t.log, event)
+	t.lastActiveAt = event.Time
+
+	for s := range t.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			h.remove(s)
+		}
+	}
+
+	return event
+}
+
+// HasSubscribers reports whether anybody is subscribed to the events of the game.
+func (h *Hub) HasSubscribers(gameID uint) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.games[gameID]
+
+	return ok && len(t.subscribers) > 0
+}
+
+// DeleteExpired forgets the events of games nobody is subscribed to and nothing has happened in for a while.
+func (h *Hub) DeleteExpired() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for gameID, t := range h.games {
+		if len(t.subscribers) == 0 && time.Since(t.lastActiveAt) > logRetention {
+			delete(h.games, gameID)
+		}
+	}
+}
+
+// topic returns the topic of the game, h.mu must be held.
+func (h *Hub) topic(gameID uint) *topic {
+	t, ok := h.games[gameID]
+	if !ok {
+		t = &topic{subscribers: map[*Subscription]struct{}{}, truncatedAt: h.lastID, lastActiveAt: time.Now()}
+		h.games[gameID] = t
+	}
+
+	return t
+}
+
+// subscribe adds a subscription to the topic of the game, h.mu must be held.
+func (h *Hub) subscribe(gameID uint) *Subscription {
+	s := &Subscription{hub: h, gameID: gameID, events: make(chan Event, subscriptionBuffer)}
+	h.topic(gameID).subscribers[s] = struct{}{}
+
+	return s
+}
+
+// remove closes the subscription, h.mu must be held.
+func (h *Hub) remove(s *Subscription) {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.events)
+
+	if t, ok := h.games[s.gameID]; ok {
+		delete(t.subscribers, s)
+		if len(t.subscribers) == 0 {
+			// the retention starts once the last subscriber is gone
+			t.lastActiveAt = time.Now()
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package events
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receive returns the next n events of the subscription and fails if they don't arrive in time.
+func receive(t *testing.T, s *Subscription, n int) []Event {
+	t.Helper()
+
+	var events []Event
+	for range n {
+		select {
+		case event, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("subscription closed after %d of %d events", len(events), n)
+			}
+
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d events", len(events), n)
+		}
+	}
+
+	return events
+}
+
+// assertNoEvent fails if an event is waiting on the subscription.
+func assertNoEvent(t *testing.T, s *Subscription) {
+	t.Helper()
+
+	select {
+	case event := <-s.Events():
+		t.Fatalf("received unexpected event %+v", event)
+	default:
+	}
+}
+
+// assertClosed fails unless the subscription has been closed once the waiting events have been read.
+func assertClosed(t *testing.T, s *Subscription) {
+	t.Helper()
+
+	for {
+		select {
+		case _, ok := <-s.Events():
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("subscription has not been closed")
+		}
+	}
+}
+
+func publishAll(h *Hub, gameID uint, n int) []Event {
+	var events []Event
+	for range n {
+		events = append(events, h.Publish(gameID, ScoresUpdated, nil))
+	}
+
+	return events
+}
+
+func TestPublishDeliversToAllSubscribersOfGame(t *testing.T) {
+	h := NewHub()
+	first := h.Subscribe(1)
+	second := h.Subscribe(1)
+
+	published := publishAll(h, 1, 3)
+
+	for _, s := range []*Subscription{first, second} {
+		for i, event := range receive(t, s, len(published)) {
+			if event.ID != published[i].ID || event.GameID != 1 {
+				t.Errorf("event %d = %+v, want %+v", i, event, published[i])
+			}
+		}
+	}
+}
+
+func TestPublishOnlyDeliversToSubscribersOfGame(t *testing.T) {
+	h := NewHub()
+	first := h.Subscribe(1)
+	second := h.Subscribe(2)
+
+	event := h.Publish(1, PlayerJoined, nil)
+
+	if got := receive(t, first, 1)[0]; got.ID != event.ID {
+		t.Errorf("subscriber of game 1 received %+v, want %+v", got, event)
+	}
+
+	assertNoEvent(t, second)
+
+	if h.HasSubscribers(3) {
+		t.Error("game 3 has subscribers")
+	}
+}
+
+func TestPublishDropsSlowSubscribers(t *testing.T) {
+	h := NewHub()
+	slow := h.Subscribe(1)
+	fast := h.Subscribe(1)
+
+	for range subscriptionBuffer + 1 {
+		h.Publish(1, ScoresUpdated, nil)
+		receive(t, fast, 1)
+	}
+
+	// the slow subscriber gets what fit into its buffer, then its channel is closed
+	receive(t, slow, subscriptionBuffer)
+	assertClosed(t, slow)
+
+	event := h.Publish(1, ScoresUpdated, nil)
+	if got := receive(t, fast, 1)[0]; got.ID != event.ID {
+		t.Errorf("fast subscriber received %+v, want %+v", got, event)
+	}
+
+	// closing a dropped subscription has no effect
+	slow.Close()
+
+	if !h.HasSubscribers(1) {
+		t.Error("fast subscriber has been dropped as well")
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	h := NewHub()
+	s := h.Subscribe(1)
+
+	s.Close()
+	s.Close()
+
+	assertClosed(t, s)
+
+	if h.HasSubscribers(1) {
+		t.Error("game still has subscribers after Close")
+	}
+
+	// the closed subscription must not be sent to anymore, which would panic
+	h.Publish(1, ScoresUpdated, nil)
+}
+
+func TestCloseStopsConsumers(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	h := NewHub()
+	var subscriptions []*Subscription
+	var wg sync.WaitGroup
+
+	for range 10 {
+		s := h.Subscribe(1)
+		subscriptions = append(subscriptions, s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range s.Events() {
+			}
+		}()
+	}
+
+	publishAll(h, 1, 5)
+
+	for _, s := range subscriptions {
+		s.Close()
+	}
+
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are running after Close, want at most %d", runtime.NumGoroutine(), before)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeReplaysEventsAfterLastEventID(t *testing.T) {
+	h := NewHub()
+	published := publishAll(h, 1, 5)
+	publishAll(h, 2, 1)
+
+	s, missed, ok := h.Resume(1, published[1].ID)
+	if !ok {
+		t.Fatal("Resume() reported missed events")
+	}
+
+	if len(missed) != 3 || missed[0].ID != published[2].ID || missed[2].ID != published[4].ID {
+		t.Errorf("Resume() returned %+v, want the last 3 events of game 1", missed)
+	}
+
+	event := h.Publish(1, ScoresUpdated, nil)
+	if got := receive(t, s, 1)[0]; got.ID != event.ID {
+		t.Errorf("received %+v after resuming, want %+v", got, event)
+	}
+
+	if _, missed, ok := h.Resume(1, event.ID); !ok || len(missed) != 0 {
+		t.Errorf("Resume() with the latest ID = %+v, %v, want nothing missed", missed, ok)
+	}
+}
+
+func TestResumeAfterLogHasBeenTruncated(t *testing.T) {
+	h := NewHub()
+	published := publishAll(h, 1, logSize+10)
+
+	// the first 10 events have been dropped from the log, everything after the 10th is still there
+	if _, _, ok := h.Resume(1, published[8].ID); ok {
+		t.Error("Resume() before the truncated events reported nothing missed")
+	}
+
+	_, missed, ok := h.Resume(1, published[9].ID)
+	if !ok {
+		t.Fatal("Resume() after the truncated events reported missed events")
+	}
+
+	if len(missed) != logSize || missed[0].ID != published[10].ID {
+		t.Errorf("Resume() returned %d events starting at %d, want %d starting at %d", len(missed), missed[0].ID, logSize, published[10].ID)
+	}
+}
+
+func TestResumeWithUnknownEventIDResets(t *testing.T) {
+	h := NewHub()
+
+	// an ID handed out by a previous process
+	if _, missed, ok := h.Resume(1, 1); ok || missed != nil {
+		t.Errorf("Resume() with an old ID = %+v, %v, want a reset", missed, ok)
+	}
+
+	event := h.Publish(1, ScoresUpdated, nil)
+
+	if _, missed, ok := h.Resume(1, event.ID+100); ok || missed != nil {
+		t.Errorf("Resume() with an ID from the future = %+v, %v, want a reset", missed, ok)
+	}
+
+	// a game nobody has subscribed to before has missed everything published before its log started
+	if _, _, ok := h.Resume(2, event.ID-1); ok {
+		t.Error("Resume() of a new game with an ID before its log reported nothing missed")
+	}
+}
+
+func TestResumeWhilePublishing(t *testing.T) {
+	const total = 1000
+
+	h := NewHub()
+	first := h.Publish(1, ScoresUpdated, nil)
+
+	var latest atomic.Uint64
+	latest.Store(first.ID)
+
+	go func() {
+		for range total {
+			latest.Store(h.Publish(1, ScoresUpdated, nil).ID)
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+
+	lastID := first.ID + total
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// resume a few events behind the publisher, which is still going
+			time.Sleep(time.Duration(i) * time.Millisecond)
+			from := max(latest.Load()-5, first.ID)
+
+			s, missed, ok := h.Resume(1, from)
+			if !ok {
+				t.Errorf("Resume(%d) reported missed events", from)
+				return
+			}
+
+			defer s.Close()
+
+			expected := from + 1
+			check := func(event Event) {
+				if event.ID != expected {
+					t.Errorf("resumed from %d: got event %d, want %d", from, event.ID, expected)
+				}
+
+				expected = event.ID + 1
+			}
+
+			for _, event := range missed {
+				check(event)
+			}
+
+			for expected <= lastID {
+				select {
+				case event, ok := <-s.Events():
+					if !ok {
+						t.Errorf("resumed from %d: subscription dropped at %d", from, expected)
+						return
+					}
+
+					check(event)
+				case <-time.After(5 * time.Second):
+					t.Errorf("resumed from %d: event %d has not arrived", from, expected)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -1,20 +1,24 @@
 package middlewares
 
 import (
+	"errors"
 	"log/slog"
-	"net/http"
 	"strings"
 
-	"github.com/domnikl/music-box-game/backend/internal/repositories"
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/services"
 	"github.com/labstack/echo/v4"
 )
 
 type APIUserAuthMiddleware struct {
-	userRepository *repositories.UserRepository
+	apiTokenService *services.APITokenService
+	// allowQueryToken accepts the API token in the api_token query parameter, which ends up in logs
+	allowQueryToken bool
 }
 
-func NewAPIUserAuthMiddleware(userRepository *repositories.UserRepository) APIUserAuthMiddleware {
-	return APIUserAuthMiddleware{userRepository: userRepository}
+func NewAPIUserAuthMiddleware(apiTokenService *services.APITokenService, allowQueryToken bool) APIUserAuthMiddleware {
+	return APIUserAuthMiddleware{apiTokenService: apiTokenService, allowQueryToken: allowQueryToken}
 }
 
 func (m APIUserAuthMiddleware) IsAuthenticated(next echo.HandlerFunc) echo.HandlerFunc {
@@ -24,30 +28,41 @@ func (m APIUserAuthMiddleware) IsAuthenticated(next echo.HandlerFunc) echo.Handl
 			return err
 		}
 
-		if apiToken == "" {
+		if apiToken == "" && m.allowQueryToken {
 			apiToken = apiTokenFromQuery(c)
 		}
 
 		if apiToken == "" {
-			apiToken = apiTokenFromState(c)
+			return apierrors.ErrUnauthorized
 		}
 
-		if apiToken == "" {
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"message": "Unauthorized",
-			})
+		user, token, err := m.apiTokenService.Authenticate(apiToken)
+		if err != nil {
+			if !errors.Is(err, services.ErrInvalidAPIToken) {
+				slog.Error("Failed to find user by API token", "error", err)
+			}
+
+			return apierrors.ErrUnauthorized
 		}
 
-		user, err := m.userRepository.FindUserByAPIToken(apiToken)
-		if err != nil || user == nil {
-			slog.Error("Failed to find user by API token", "error", err)
+		c.Set("user", user)
+		c.Set("apiToken", token)
+
+		return next(c)
+	}
+}
 
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"message": "Unauthorized",
-			})
+// NoGuests keeps guests out of everything but the game they have joined. It has to run after IsAuthenticated.
+func (m APIUserAuthMiddleware) NoGuests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return apierrors.ErrUnauthorized
 		}
 
-		c.Set("user", user)
+		if user.IsGuest() {
+			return services.ErrGuestNotAllowed
+		}
 
 		return next(c)
 	}
@@ -57,9 +72,7 @@ func apiTokenFromHeader(c echo.Context) (string, error) {
 	apiToken := c.Request().Header.Get("Authorization")
 
 	if apiToken != "" && !strings.HasPrefix(apiToken, "Bearer ") {
-		return "", c.JSON(http.StatusUnauthorized, map[string]string{
-			"message": "Unauthorized",
-		})
+		return "", apierrors.ErrUnauthorized
 	}
 
 	return strings.TrimPrefix(apiToken, "Bearer "), nil
@@ -68,17 +81,3 @@ func apiTokenFromHeader(c echo.Context) (string, error) {
 func apiTokenFromQuery(c echo.Context) string {
 	return c.QueryParam("api_token")
 }
-
-func apiTokenFromState(c echo.Context) string {
-	state := c.QueryParam("state")
-	if state == "" {
-		return ""
-	}
-
-	parts := strings.Split(state, ":")
-	if len(parts) != 2 {
-		return ""
-	}
-
-	return parts[1]
-}
@@ -0,0 +1,99 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// joinCodeBodyLimit is how much of the body is read to find the join code in.
+const joinCodeBodyLimit = 4096
+
+// RateLimit allows count requests per period, either per client IP, per join code or globally, with bursts of
+// up to burst requests.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+	Burst  int
+}
+
+func (r RateLimit) limit() rate.Limit {
+	return rate.Limit(float64(r.Count) / r.Period.Seconds())
+}
+
+// retryAfter is the time it takes until another request is allowed after the limit has been reached.
+func (r RateLimit) retryAfter() time.Duration {
+	return r.Period / time.Duration(r.Count)
+}
+
+// PerIPRateLimit limits the requests of every client IP separately.
+func PerIPRateLimit(limit RateLimit) echo.MiddlewareFunc {
+	return rateLimit(limit, func(c echo.Context) (string, error) {
+		return c.RealIP(), nil
+	})
+}
+
+// PerJoinCodeRateLimit limits the requests for every join code separately, no matter who sends them. The
+// code is read from the "code" field of the JSON body, which is left in place for the handler.
+func PerJoinCodeRateLimit(limit RateLimit) echo.MiddlewareFunc {
+	return rateLimit(limit, func(c echo.Context) (string, error) {
+		return "code:" + joinCode(c.Request()), nil
+	})
+}
+
+// joinCode returns the normalized join code of the request body or an empty string if there is none.
+func joinCode(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	head, err := io.ReadAll(io.LimitReader(r.Body, joinCodeBodyLimit))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+	if err != nil {
+		return ""
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.Unmarshal(head, &body); err != nil {
+		return ""
+	}
+
+	return strings.ToUpper(strings.TrimSpace(body.Code))
+}
+
+// GlobalRateLimit limits the requests of all clients together.
+func GlobalRateLimit(limit RateLimit) echo.MiddlewareFunc {
+	return rateLimit(limit, func(c echo.Context) (string, error) {
+		return "global", nil
+	})
+}
+
+func rateLimit(limit RateLimit, identifier middleware.Extractor) echo.MiddlewareFunc {
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		IdentifierExtractor: identifier,
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:  limit.limit(),
+			Burst: limit.Burst,
+			// limiters must be kept until they would have been refilled, otherwise clients could wait for them to expire
+			ExpiresIn: limit.Period,
+		}),
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			return apierrors.TooManyRequests("Too many requests, please try again later", limit.retryAfter())
+		},
+	})
+}
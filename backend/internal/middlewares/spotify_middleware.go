@@ -1,9 +1,10 @@
 package middlewares
 
 import (
-	"net/http"
-
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
 	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,15 +19,20 @@ func (m SpotifyMiddleware) HasToken(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		user, ok := c.Get("user").(*models.User)
 		if !ok {
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"message": "Unauthorized",
-			})
+			return apierrors.ErrUnauthorized
+		}
+
+		// guests can't link Spotify, playback always uses the host's account
+		if user.IsGuest() {
+			return services.ErrGuestNotAllowed
+		}
+
+		if user.SpotifyLinkBroken() {
+			return spotify.ErrTokenRevoked
 		}
 
 		if user.SpotifyRefreshToken == "" {
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"message": "Missing Spotify token",
-			})
+			return apierrors.ErrSpotifyNotLinked
 		}
 
 		return next(c)
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// APIToken authenticates the app of a user on one device. Only a hash of the token is stored, Prefix
+// is the start of the token so the user can tell tokens apart.
+type APIToken struct {
+	ID         uint       `json:"id" gorm:"primarykey"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	UserID     uint       `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// Valid reports whether the token can still be used to authenticate.
+func (t *APIToken) Valid(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
@@ -0,0 +1,225 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	GameStatusCreated  = "created"
+	GameStatusRunning  = "running"
+	GameStatusFinished = "finished"
+
+	RoundStatusPlaying  = "playing"
+	RoundStatusRevealed = "revealed"
+
+	// GameModeClassic lets players guess the release year of each track and awards points for being close.
+	GameModeClassic = "classic"
+	// GameModeTimeline lets every player build a chronological timeline of cards, Hitster-style.
+	GameModeTimeline = "timeline"
+
+	// GamePlaybackRemote lets the backend start each track on the host's Spotify device, which requires Spotify Premium.
+	GamePlaybackRemote = "remote"
+	// GamePlaybackHostDevice leaves playback to the host's app, e.g. by opening the track in Spotify, so hosts
+	// with Spotify Free can play too. The other players only guess.
+	GamePlaybackHostDevice = "host_device"
+)
+
+type Game struct {
+	ID        uint           `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	// UserID is the host of the game, whose Spotify account is used for playback
+	UserID      uint   `json:"userId"`
+	PlaylistID  string `json:"playlistId"`
+	Status      string `json:"status"`
+	Mode        string `json:"mode"`
+	Playback    string `json:"playback"`
+	MaxRounds   int    `json:"maxRounds"`
+	TargetCards int    `json:"targetCards,omitempty"`
+	WinnerID    *uint  `json:"winnerId"`
+	// JoinCode lets other users join the game from the lobby until JoinCodeExpiresAt
+	JoinCode          string     `json:"joinCode,omitempty"`
+	JoinCodeExpiresAt *time.Time `json:"joinCodeExpiresAt,omitempty"`
+	Players           []Player   `json:"players"`
+	Rounds            []Round    `json:"rounds"`
+}
+
+// CurrentRound returns the latest round of the game or nil if no round has been started yet.
+func (g *Game) CurrentRound() *Round {
+	if len(g.Rounds) == 0 {
+		return nil
+	}
+
+	return &g.Rounds[len(g.Rounds)-1]
+}
+
+// IsHost reports whether the user hosts the game.
+func (g *Game) IsHost(userID uint) bool {
+	return g.UserID == userID
+}
+
+// FindPlayerByUser returns the player the user has joined the game as or nil if the user hasn't joined it.
+func (g *Game) FindPlayerByUser(userID uint) *Player {
+	for i := range g.Players {
+		if g.Players[i].UserID != nil && *g.Players[i].UserID == userID {
+			return &g.Players[i]
+		}
+	}
+
+	return nil
+}
+
+// FindPlayer returns the player with the given ID or nil if it is not part of the game.
+func (g *Game) FindPlayer(id uint) *Player {
+	for i := range g.Players {
+		if g.Players[i].ID == id {
+			return &g.Players[i]
+		}
+	}
+
+	return nil
+}
+
+type Player struct {
+	ID        uint           `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	GameID    uint           `json:"gameId"`
+	UserID    *uint          `json:"userId"`
+	Name      string         `json:"name"`
+	Ready     bool           `json:"ready"`
+	Score     int            `json:"score"`
+	Cards     []TimelineCard `json:"cards,omitempty"`
+}
+
+// TimelineCard is a track a player has correctly placed in their timeline.
+// Cards are kept sorted by release year; cards with the same year are sorted by the time they were won.
+type TimelineCard struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	CreatedAt   time.Time `json:"createdAt"`
+	PlayerID    uint      `json:"playerId"`
+	TrackID     string    `json:"trackId"`
+	TrackName   string    `json:"trackName"`
+	ArtistName  string    `json:"artistName"`
+	ReleaseYear int       `json:"releaseYear"`
+}
+
+// Round is a single track played in a game. ReleaseDatePrecision is one of the ReleaseDatePrecision*
+// constants. OriginalYear is the corrected year of the first release as found by OriginalYearSource.
+// Unscored is set when the release date turned out to be malformed, so no points were awarded.
+type Round struct {
+	ID                   uint      `json:"id" gorm:"primarykey"`
+	CreatedAt            time.Time `json:"createdAt"`
+	UpdatedAt            time.Time `json:"updatedAt"`
+	GameID               uint      `json:"gameId"`
+	Number               int       `json:"number"`
+	Status               string    `json:"status"`
+	TrackID              string    `json:"trackId"`
+	TrackName            string    `json:"trackName"`
+	ArtistName           string    `json:"artistName"`
+	AlbumName            string    `json:"albumName"`
+	ReleaseDate          string    `json:"releaseDate"`
+	ReleaseDatePrecision string    `json:"releaseDatePrecision"`
+	OriginalYear         int       `json:"originalYear,omitempty"`
+	OriginalYearSource   string    `json:"originalYearSource,omitempty"`
+	Unscored             bool      `json:"unscored"`
+	Guesses              []Guess   `json:"guesses"`
+}
+
+func (r *Round) Release() (ReleaseDate, error) {
+	return ParseReleaseDate(r.ReleaseDate, r.ReleaseDatePrecision)
+}
+
+// ScoringDate returns the date guesses are scored against.
+func (r *Round) ScoringDate() (ReleaseDate, error) {
+	return scoringDate(r.ReleaseDate, r.ReleaseDatePrecision, r.OriginalYear)
+}
+
+// Redacted returns a copy of the round without any information about the track
+// as long as it has not been revealed, so players can't cheat by looking at the response.
+func (r Round) Redacted() Round {
+	if r.Status == RoundStatusRevealed {
+		return r
+	}
+
+	r.TrackID = ""
+	r.TrackName = ""
+	r.ArtistName = ""
+	r.AlbumName = ""
+	r.ReleaseDate = ""
+	r.ReleaseDatePrecision = ""
+	r.OriginalYear = 0
+	r.OriginalYearSource = ""
+
+	return r
+}
+
+// FindGuess returns the guess of the given player or nil if the player has not guessed yet.
+func (r *Round) FindGuess(playerID uint) *Guess {
+	for i := range r.Guesses {
+		if r.Guesses[i].PlayerID == playerID {
+			return &r.Guesses[i]
+		}
+	}
+
+	return nil
+}
+
+type Guess struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	RoundID   uint      `json:"roundId"`
+	PlayerID  uint      `json:"playerId"`
+	Year      int       `json:"year,omitempty"`
+	Position  *int      `json:"position,omitempty"`
+	Correct   bool      `json:"correct"`
+	Points    int       `json:"points"`
+}
+
+const (
+	// OriginalYearSourceReference means the year was taken from the offline reference dataset.
+	OriginalYearSourceReference = "reference"
+	// OriginalYearSourcePlaylist means an earlier release of the same recording was found in the playlist.
+	OriginalYearSourcePlaylist = "playlist"
+)
+
+// Track is a playable track as picked for a round.
+//
+// Spotify often dates a track to a remaster or compilation instead of its first release. OriginalYear holds
+// the corrected year if one could be found, OriginalYearSource where it came from. ReleaseYearSuspect is set
+// if the album looks like a remaster or compilation, but no better year is known.
+type Track struct {
+	ID                   string `json:"id"`
+	ISRC                 string `json:"isrc"`
+	Name                 string `json:"name"`
+	ArtistName           string `json:"artistName"`
+	AlbumName            string `json:"albumName"`
+	AlbumType            string `json:"albumType"`
+	ReleaseDate          string `json:"releaseDate"`
+	ReleaseDatePrecision string `json:"releaseDatePrecision"`
+	OriginalYear         int    `json:"originalYear,omitempty"`
+	OriginalYearSource   string `json:"originalYearSource,omitempty"`
+	ReleaseYearSuspect   bool   `json:"releaseYearSuspect"`
+}
+
+func (t *Track) Release() (ReleaseDate, error) {
+	return ParseReleaseDate(t.ReleaseDate, t.ReleaseDatePrecision)
+}
+
+// ScoringDate returns the date guesses are scored against.
+func (t *Track) ScoringDate() (ReleaseDate, error) {
+	return scoringDate(t.ReleaseDate, t.ReleaseDatePrecision, t.OriginalYear)
+}
+
+// scoringDate prefers a corrected original year over the date Spotify reports.
+func scoringDate(releaseDate, precision string, originalYear int) (ReleaseDate, error) {
+	if originalYear > 0 {
+		return ReleaseDate{Year: originalYear, Precision: ReleaseDatePrecisionYear}, nil
+	}
+
+	return ParseReleaseDate(releaseDate, precision)
+}
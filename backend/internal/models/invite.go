@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Invite allows to register a single user while registration requires invites.
+type Invite struct {
+	ID           string     `json:"id" gorm:"primarykey"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	UsedAt       *time.Time `json:"usedAt"`
+	UsedByUserID *uint      `json:"usedByUserId"`
+}
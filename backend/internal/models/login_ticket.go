@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// LoginTicket lets the browser of a user link Spotify without knowing the user's API token. Only a
+// hash of the ticket is stored and it can be used once before it expires.
+type LoginTicket struct {
+	ID        uint       `json:"-" gorm:"primarykey"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UserID    uint       `json:"-"`
+	Hash      string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"-"`
+	// RedirectURI is the app's deep link the user returns to after linking Spotify
+	RedirectURI string `json:"redirectUri"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// MergeRequest is raised when a user links a Spotify account another user has linked before, e.g.
+// before the app has been reinstalled. The user is only merged into the one that owns the account once
+// the request has been accepted from a device logged in as that user.
+type MergeRequest struct {
+	ID         uint      `json:"id" gorm:"primarykey"`
+	CreatedAt  time.Time `json:"createdAt"`
+	FromUserID uint      `json:"-"`
+	IntoUserID uint      `json:"-"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// OAuthState is the state of a Spotify authorization in progress. It is kept on the server along with
+// the user it has been started for, the browser only holds the state in its session. Only a hash of
+// the state sent to Spotify is stored.
+type OAuthState struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint
+	Hash      string
+	// RedirectURI is the app's deep link the user returns to after linking Spotify
+	RedirectURI string
+	// CodeVerifier is the PKCE verifier of the authorization
+	CodeVerifier string
+	ExpiresAt    time.Time
+	UsedAt       *time.Time
+}
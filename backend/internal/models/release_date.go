@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ReleaseDatePrecisionYear  = "year"
+	ReleaseDatePrecisionMonth = "month"
+	ReleaseDatePrecisionDay   = "day"
+)
+
+var ErrMalformedReleaseDate = errors.New("malformed release date")
+
+// ReleaseDate is a release date as returned by Spotify, which may only be known to the year or month.
+// Month and Day are 0 if they are not covered by the precision.
+type ReleaseDate struct {
+	Year      int
+	Month     int
+	Day       int
+	Precision string
+}
+
+// ParseReleaseDate parses a date in the formats "YYYY", "YYYY-MM" or "YYYY-MM-DD". If precision is given,
+// it must match the format of the value. Dates without a real year (e.g. "0000") are rejected.
+func ParseReleaseDate(value string, precision string) (ReleaseDate, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) > 3 || len(parts[0]) != 4 {
+		return ReleaseDate{}, fmt.Errorf("%w: %q", ErrMalformedReleaseDate, value)
+	}
+
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		if i > 0 && len(part) != 2 {
+			return ReleaseDate{}, fmt.Errorf("%w: %q", ErrMalformedReleaseDate, value)
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return ReleaseDate{}, fmt.Errorf("%w: %q", ErrMalformedReleaseDate, value)
+		}
+
+		numbers[i] = n
+	}
+
+	date := ReleaseDate{Year: numbers[0], Precision: ReleaseDatePrecisionYear}
+
+	if len(numbers) > 1 {
+		date.Month = numbers[1]
+		date.Precision = ReleaseDatePrecisionMonth
+		if date.Month > 12 {
+			return ReleaseDate{}, fmt.Errorf("%w: %q", ErrMalformedReleaseDate, value)
+		}
+	}
+
+	if len(numbers) > 2 {
+		date.Day = numbers[2]
+		date.Precision = ReleaseDatePrecisionDay
+		t := time.Date(date.Year, time.Month(date.Month), date.Day, 0, 0, 0, 0, time.UTC)
+		if t.Day() != date.Day {
+			return ReleaseDate{}, fmt.Errorf("%w: %q", ErrMalformedReleaseDate, value)
+		}
+	}
+
+	if precision != "" && precision != date.Precision {
+		return ReleaseDate{}, fmt.Errorf("%w: %q does not have precision %s", ErrMalformedReleaseDate, value, precision)
+	}
+
+	return date, nil
+}
+
+// Decade returns the first year of the decade the date falls into, e.g. 1980 for 1987.
+func (d ReleaseDate) Decade() int {
+	return d.Year - d.Year%10
+}
+
+// YearsFrom returns how many years the given year is away from the release year.
+func (d ReleaseDate) YearsFrom(year int) int {
+	if year > d.Year {
+		return year - d.Year
+	}
+
+	return d.Year - year
+}
+
+// SameDecade reports whether the given year falls into the same decade as the release date.
+func (d ReleaseDate) SameDecade(year int) bool {
+	return year-year%10 == d.Decade()
+}
+
+func (d ReleaseDate) String() string {
+	switch d.Precision {
+	case ReleaseDatePrecisionDay:
+		return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+	case ReleaseDatePrecisionMonth:
+		return fmt.Sprintf("%04d-%02d", d.Year, d.Month)
+	default:
+		return fmt.Sprintf("%04d", d.Year)
+	}
+}
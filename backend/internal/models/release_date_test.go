@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseReleaseDate(t *testing.T) {
+	tests := []struct {
+		value     string
+		precision string
+		want      ReleaseDate
+		wantErr   bool
+	}{
+		{value: "1987", precision: "year", want: ReleaseDate{Year: 1987, Precision: ReleaseDatePrecisionYear}},
+		{value: "1987-06", precision: "month", want: ReleaseDate{Year: 1987, Month: 6, Precision: ReleaseDatePrecisionMonth}},
+		{value: "1987-06-15", precision: "day", want: ReleaseDate{Year: 1987, Month: 6, Day: 15, Precision: ReleaseDatePrecisionDay}},
+		{value: "1988-02-29", want: ReleaseDate{Year: 1988, Month: 2, Day: 29, Precision: ReleaseDatePrecisionDay}},
+		{value: "0000", wantErr: true},
+		{value: "0000-00-00", wantErr: true},
+		{value: "1987", precision: "day", wantErr: true},
+		{value: "1987-06-15", precision: "year", wantErr: true},
+		{value: "1987-02-29", wantErr: true},
+		{value: "1987-04-31", wantErr: true},
+		{value: "1987-13", wantErr: true},
+		{value: "1987-6", wantErr: true},
+		{value: "87", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "1987-06-15-01", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value+"/"+test.precision, func(t *testing.T) {
+			got, err := ParseReleaseDate(test.value, test.precision)
+
+			if test.wantErr {
+				if !errors.Is(err, ErrMalformedReleaseDate) {
+					t.Errorf("ParseReleaseDate() error = %v, want %v", err, ErrMalformedReleaseDate)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseReleaseDate() error = %v", err)
+			}
+
+			if got != test.want {
+				t.Errorf("ParseReleaseDate() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReleaseDateDecade(t *testing.T) {
+	tests := []struct {
+		year       int
+		guess      int
+		decade     int
+		sameDecade bool
+	}{
+		{year: 1987, guess: 1980, decade: 1980, sameDecade: true},
+		{year: 1987, guess: 1989, decade: 1980, sameDecade: true},
+		{year: 1980, guess: 1979, decade: 1980, sameDecade: false},
+		{year: 2000, guess: 2009, decade: 2000, sameDecade: true},
+		{year: 1999, guess: 2000, decade: 1990, sameDecade: false},
+	}
+
+	for _, test := range tests {
+		date := ReleaseDate{Year: test.year, Precision: ReleaseDatePrecisionYear}
+
+		if got := date.Decade(); got != test.decade {
+			t.Errorf("ReleaseDate{Year: %d}.Decade() = %d, want %d", test.year, got, test.decade)
+		}
+
+		if got := date.SameDecade(test.guess); got != test.sameDecade {
+			t.Errorf("ReleaseDate{Year: %d}.SameDecade(%d) = %v, want %v", test.year, test.guess, got, test.sameDecade)
+		}
+	}
+}
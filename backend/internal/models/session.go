@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Session holds the values of a browser session, encoded and authenticated by the session store.
+type Session struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Data      string
+	ExpiresAt time.Time
+}
@@ -6,12 +6,63 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	SpotifyProductPremium = "premium"
+	SpotifyProductFree    = "free"
+)
+
+// SpotifyProfile is the Spotify account a user has linked.
+type SpotifyProfile struct {
+	UserID      string `json:"userId"`
+	DisplayName string `json:"displayName"`
+	Country     string `json:"country"`
+	// Product is the subscription of the account, e.g. "premium" or "free"
+	Product   string `json:"product"`
+	AvatarURL string `json:"avatarUrl"`
+}
+
 type User struct {
-	ID                  uint           `json:"id" gorm:"primarykey"`
-	CreatedAt           time.Time      `json:"createdAt"`
-	UpdatedAt           time.Time      `json:"updatedAt"`
-	DeletedAt           gorm.DeletedAt `json:"-" gorm:"index"`
-	APIToken            string         `json:"apiToken"`
-	SpotifyToken        string         `json:"-"`
-	SpotifyRefreshToken string         `json:"-"`
+	ID                    uint           `json:"id" gorm:"primarykey"`
+	CreatedAt             time.Time      `json:"createdAt"`
+	UpdatedAt             time.Time      `json:"updatedAt"`
+	DeletedAt             gorm.DeletedAt `json:"-" gorm:"index"`
+	CreatedVia            string         `json:"createdVia"`
+	SpotifyToken          string         `json:"-"`
+	SpotifyRefreshToken   string         `json:"-"`
+	SpotifyTokenExpiresAt *time.Time     `json:"-"`
+	SpotifyTokenKeyID     string         `json:"-"`
+	SpotifyTokenDataKey   string         `json:"-"`
+	SpotifyLinkBrokenAt   *time.Time     `json:"spotifyLinkBrokenAt,omitempty"`
+	SpotifyProfile        SpotifyProfile `json:"spotifyProfile" gorm:"embedded;embeddedPrefix:spotify_"`
+	PreferredDeviceID     string         `json:"preferredDeviceId"`
+	LastDeviceID          string         `json:"lastDeviceId"`
+	// GuestGameID is the game a guest has joined, guests can't do anything outside of it
+	GuestGameID *uint `json:"guestGameId,omitempty"`
+}
+
+// IsGuest reports whether the user is a guest who has joined a single game without registering.
+func (u *User) IsGuest() bool {
+	return u.GuestGameID != nil
+}
+
+// SpotifyLinked reports whether the user has linked Spotify and the link still works.
+func (u *User) SpotifyLinked() bool {
+	return u.SpotifyRefreshToken != "" && !u.SpotifyLinkBroken()
+}
+
+// SpotifyLinkBroken reports whether Spotify has rejected the refresh token, e.g. because the user
+// removed the app from their account. The user has to link Spotify again.
+func (u *User) SpotifyLinkBroken() bool {
+	return u.SpotifyLinkBrokenAt != nil
+}
+
+// SpotifyPremium reports whether the linked account is known to be on Spotify Premium.
+func (u *User) SpotifyPremium() bool {
+	return u.SpotifyProfile.Product == SpotifyProductPremium
+}
+
+// SpotifyPremiumRequired reports whether the linked account is known to lack Spotify Premium, which
+// is needed to control playback. Accounts without a known product are given the benefit of the doubt.
+func (u *User) SpotifyPremiumRequired() bool {
+	return u.SpotifyProfile.Product != "" && !u.SpotifyPremium()
 }
@@ -0,0 +1,389 @@
+// Package nowplaying polls what the hosts of games are playing on Spotify. Each host is polled once,
+// no matter how many clients ask, and changes are published to the games of the host.
+package nowplaying
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/apierrors"
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/repositories"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+)
+
+const (
+	playingInterval = 3 * time.Second
+	pausedInterval  = 10 * time.Second
+	errorInterval   = 15 * time.Second
+	minInterval     = time.Second
+	// endOfTrackDelay is added to the time left of the track, so the next track is picked up right after it has started.
+	endOfTrackDelay = 500 * time.Millisecond
+	// seekTolerance is how far the progress may be off before it counts as a seek, polls take some time themselves.
+	seekTolerance = 2 * time.Second
+	// idleTimeout is how long a host is polled after the last request once nobody is subscribed to its games.
+	idleTimeout = 2 * time.Minute
+)
+
+// Clock abstracts time, so polling can be tested without waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type Option func(*Poller)
+
+// WithClock replaces the system clock.
+func WithClock(clock Clock) Option {
+	return func(p *Poller) {
+		p.clock = clock
+	}
+}
+
+// Poller keeps the latest playback state of every host that has been asked for recently or whose games
+// have subscribers, polling Spotify at an interval adapted to the playback.
+type Poller struct {
+	spotify     *spotify.Spotify
+	userService *services.UserService
+	hub         *events.Hub
+	clock       Clock
+
+	mu    sync.Mutex
+	hosts map[uint]*host
+}
+
+type host struct {
+	userID uint
+	// wake makes the host be polled right away, e.g. after playback has been changed through the API.
+	wake chan struct{}
+	// ready is closed once the host has been polled for the first time.
+	ready chan struct{}
+
+	// the fields below are guarded by Poller.mu
+	games       map[uint]time.Time
+	requestedAt time.Time
+	state       *spotify.CurrentlyPlayingResponse
+	err         error
+	fetchedAt   time.Time
+}
+
+func NewPoller(spotify *spotify.Spotify, userService *services.UserService, hub *events.Hub, options ...Option) *Poller {
+	p := &Poller{spotify: spotify, userService: userService, hub: hub, clock: realClock{}, hosts: map[uint]*host{}}
+
+	for _, option := range options {
+		option(p)
+	}
+
+	return p
+}
+
+// Get returns what the user is currently playing. The first call starts polling for the user, later
+// calls are answered from the latest poll, with the progress of a playing track moved on accordingly.
+func (p *Poller) Get(user *models.User) (*spotify.CurrentlyPlayingResponse, error) {
+	return p.state(p.host(user))
+}
+
+// GetHost returns what the host of the game is currently playing, like Get, for players who can't ask
+// Spotify themselves.
+func (p *Poller) GetHost(game *models.Game) (*spotify.CurrentlyPlayingResponse, error) {
+	p.mu.Lock()
+	h, ok := p.hosts[game.UserID]
+	if ok {
+		h.requestedAt = p.clock.Now()
+	}
+	p.mu.Unlock()
+
+	if ok {
+		return p.state(h)
+	}
+
+	user, err := p.userService.FindUser(game.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.SpotifyLinkBroken() {
+		return nil, spotify.ErrTokenRevoked
+	}
+
+	if user.SpotifyRefreshToken == "" {
+		return nil, apierrors.ErrSpotifyNotLinked
+	}
+
+	return p.Get(user)
+}
+
+// state waits for the first poll of the host and returns its latest state.
+func (p *Poller) state(h *host) (*spotify.CurrentlyPlayingResponse, error) {
+	<-h.ready
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	return extrapolate(h.state, p.clock.Now().Sub(h.fetchedAt)), nil
+}
+
+// Watch publishes changes of the playback of the game's host to the game as long as anybody is
+// subscribed to its events.
+func (p *Poller) Watch(game *models.Game) error {
+	p.mu.Lock()
+	h, ok := p.hosts[game.UserID]
+	if ok {
+		h.games[game.ID] = p.clock.Now()
+	}
+	p.mu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	user, err := p.userService.FindUser(game.UserID)
+	if err != nil {
+		return err
+	}
+
+	// the playback of hosts without Spotify can't be watched
+	if !user.SpotifyLinked() {
+		return nil
+	}
+
+	h = p.host(user)
+
+	p.mu.Lock()
+	h.games[game.ID] = p.clock.Now()
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Unwatch stops publishing changes of the user's playback to the game, e.g. because the game has been
+// handed off to another host.
+func (p *Poller) Unwatch(userID, gameID uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if h, ok := p.hosts[userID]; ok {
+		delete(h.games, gameID)
+	}
+}
+
+// Refresh polls the user right away if the user is being polled, e.g. because playback has just been changed.
+func (p *Poller) Refresh(userID uint) {
+	p.mu.Lock()
+	h, ok := p.hosts[userID]
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// host returns the host of the user and starts polling it if that hasn't happened yet.
+func (p *Poller) host(user *models.User) *host {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.hosts[user.ID]
+	if !ok {
+		h = &host{
+			userID: user.ID,
+			wake:   make(chan struct{}, 1),
+			ready:  make(chan struct{}),
+			games:  map[uint]time.Time{},
+		}
+
+		p.hosts[user.ID] = h
+		go p.run(h)
+	}
+
+	h.requestedAt = p.clock.Now()
+
+	return h
+}
+
+func (p *Poller) run(h *host) {
+	var previous *spotify.CurrentlyPlayingResponse
+	var previousAt time.Time
+
+	for first := true; ; first = false {
+		state, err := p.poll(h.userID)
+		now := p.clock.Now()
+
+		p.mu.Lock()
+		h.state, h.err, h.fetchedAt = state, err, now
+		games := p.watchedGames(h, now)
+
+		// hosts who have unlinked Spotify are not polled until they are asked for again
+		stop := unlinked(err) || (len(games) == 0 && now.Sub(h.requestedAt) > idleTimeout)
+		if stop {
+			delete(p.hosts, h.userID)
+		}
+		p.mu.Unlock()
+
+		if first {
+			close(h.ready)
+		}
+
+		if err != nil && !unlinked(err) {
+			slog.Warn("Failed to poll currently playing track", "user", h.userID, "error", err)
+		}
+
+		if err == nil {
+			if previous != nil {
+				for _, change := range detectChanges(previous, state, now.Sub(previousAt)) {
+					data := events.PlaybackData{IsPlaying: state.IsPlaying, ProgressMs: state.ProgressMs, DurationMs: state.Item.DurationMs}
+					for _, gameID := range games {
+						p.hub.Publish(gameID, change, data)
+					}
+				}
+			}
+
+			previous, previousAt = state, now
+		}
+
+		if stop {
+			return
+		}
+
+		select {
+		case <-p.clock.After(interval(state, err)):
+		case <-h.wake:
+		}
+	}
+}
+
+// poll asks Spotify what the user is playing. The user is read anew every time, so tokens that have been
+// refreshed, replaced or removed in the meantime are picked up.
+func (p *Poller) poll(userID uint) (*spotify.CurrentlyPlayingResponse, error) {
+	user, err := p.userService.FindUser(userID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		// e.g. merged into another user
+		return nil, apierrors.ErrSpotifyNotLinked
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user.SpotifyLinkBroken() {
+		return nil, spotify.ErrTokenRevoked
+	}
+
+	if user.SpotifyRefreshToken == "" {
+		return nil, apierrors.ErrSpotifyNotLinked
+	}
+
+	return p.spotify.GetCurrentlyPlaying(context.Background(), user)
+}
+
+// unlinked tells whether the error means that the host can't be polled until it links Spotify again.
+func unlinked(err error) bool {
+	return errors.Is(err, spotify.ErrTokenRevoked) || errors.Is(err, apierrors.ErrSpotifyNotLinked)
+}
+
+// watchedGames returns the games changes are published to. Games nobody is subscribed to anymore are
+// dropped, unless they have just been watched. p.mu must be held.
+func (p *Poller) watchedGames(h *host, now time.Time) []uint {
+	var games []uint
+	for gameID, watchedAt := range h.games {
+		if !p.hub.HasSubscribers(gameID) && now.Sub(watchedAt) > idleTimeout {
+			delete(h.games, gameID)
+			continue
+		}
+
+		games = append(games, gameID)
+	}
+
+	return games
+}
+
+// detectChanges compares two polls that are elapsed apart and returns the events describing what has changed.
+func detectChanges(previous, current *spotify.CurrentlyPlayingResponse, elapsed time.Duration) []events.Type {
+	var changes []events.Type
+
+	trackChanged := previous.Item.ID != current.Item.ID
+	if trackChanged && current.Item.ID != "" {
+		changes = append(changes, events.TrackChanged)
+	}
+
+	switch {
+	case previous.IsPlaying && !current.IsPlaying:
+		changes = append(changes, events.PlaybackPaused)
+	case !previous.IsPlaying && current.IsPlaying:
+		changes = append(changes, events.PlaybackResumed)
+	}
+
+	if trackChanged || previous.IsPlaying != current.IsPlaying {
+		return changes
+	}
+
+	expected := time.Duration(previous.ProgressMs) * time.Millisecond
+	if current.IsPlaying {
+		expected += elapsed
+	}
+
+	if offset := time.Duration(current.ProgressMs)*time.Millisecond - expected; offset > seekTolerance || offset < -seekTolerance {
+		changes = append(changes, events.PlaybackSeeked)
+	}
+
+	return changes
+}
+
+// interval returns how long to wait before the next poll: slower while nothing is playing and faster
+// towards the end of a track, so the next one is picked up quickly.
+func interval(state *spotify.CurrentlyPlayingResponse, err error) time.Duration {
+	if err != nil {
+		var rateLimited *spotify.RateLimitedError
+		if errors.As(err, &rateLimited) && rateLimited.RetryAfter > errorInterval {
+			return rateLimited.RetryAfter
+		}
+
+		return errorInterval
+	}
+
+	if !state.IsPlaying {
+		return pausedInterval
+	}
+
+	if state.Item.DurationMs > 0 {
+		left := time.Duration(state.Item.DurationMs-state.ProgressMs)*time.Millisecond + endOfTrackDelay
+		if left < playingInterval {
+			return max(left, minInterval)
+		}
+	}
+
+	return playingInterval
+}
+
+// extrapolate returns a copy of the state with the progress of a playing track moved on by elapsed.
+func extrapolate(state *spotify.CurrentlyPlayingResponse, elapsed time.Duration) *spotify.CurrentlyPlayingResponse {
+	current := *state
+	if current.IsPlaying {
+		current.ProgressMs += int(elapsed.Milliseconds())
+		if current.Item.DurationMs > 0 {
+			current.ProgressMs = min(current.ProgressMs, current.Item.DurationMs)
+		}
+	}
+
+	return &current
+}
@@ -0,0 +1,253 @@
+package nowplaying
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+
+	return ch
+}
+
+func playback(trackID string, isPlaying bool, progress, duration time.Duration) *spotify.CurrentlyPlayingResponse {
+	state := &spotify.CurrentlyPlayingResponse{IsPlaying: isPlaying, ProgressMs: int(progress.Milliseconds())}
+	state.Item.ID = trackID
+	state.Item.DurationMs = int(duration.Milliseconds())
+
+	return state
+}
+
+func TestDetectChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous *spotify.CurrentlyPlayingResponse
+		current  *spotify.CurrentlyPlayingResponse
+		elapsed  time.Duration
+		want     []events.Type
+	}{
+		{
+			name:     "playing on",
+			previous: playback("a", true, 10*time.Second, 3*time.Minute),
+			current:  playback("a", true, 13*time.Second, 3*time.Minute),
+			elapsed:  3 * time.Second,
+		},
+		{
+			name:     "within seek tolerance",
+			previous: playback("a", true, 10*time.Second, 3*time.Minute),
+			current:  playback("a", true, 14*time.Second, 3*time.Minute),
+			elapsed:  3 * time.Second,
+		},
+		{
+			name:     "seeked forward",
+			previous: playback("a", true, 10*time.Second, 3*time.Minute),
+			current:  playback("a", true, 60*time.Second, 3*time.Minute),
+			elapsed:  3 * time.Second,
+			want:     []events.Type{events.PlaybackSeeked},
+		},
+		{
+			name:     "seeked back",
+			previous: playback("a", true, 60*time.Second, 3*time.Minute),
+			current:  playback("a", true, 5*time.Second, 3*time.Minute),
+			elapsed:  3 * time.Second,
+			want:     []events.Type{events.PlaybackSeeked},
+		},
+		{
+			name:     "paused",
+			previous: playback("a", true, 10*time.Second, 3*time.Minute),
+			current:  playback("a", false, 12*time.Second, 3*time.Minute),
+			elapsed:  3 * time.Second,
+			want:     []events.Type{events.PlaybackPaused},
+		},
+		{
+			name:     "resumed",
+			previous: playback("a", false, 12*time.Second, 3*time.Minute),
+			current:  playback("a", true, 14*time.Second, 3*time.Minute),
+			elapsed:  10 * time.Second,
+			want:     []events.Type{events.PlaybackResumed},
+		},
+		{
+			name:     "still paused",
+			previous: playback("a", false, 12*time.Second, 3*time.Minute),
+			current:  playback("a", false, 12*time.Second, 3*time.Minute),
+			elapsed:  10 * time.Second,
+		},
+		{
+			name:     "seeked while paused",
+			previous: playback("a", false, 12*time.Second, 3*time.Minute),
+			current:  playback("a", false, 90*time.Second, 3*time.Minute),
+			elapsed:  10 * time.Second,
+			want:     []events.Type{events.PlaybackSeeked},
+		},
+		{
+			name:     "track changed",
+			previous: playback("a", true, 179*time.Second, 3*time.Minute),
+			current:  playback("b", true, time.Second, 4*time.Minute),
+			elapsed:  2 * time.Second,
+			want:     []events.Type{events.TrackChanged},
+		},
+		{
+			name:     "track changed and paused",
+			previous: playback("a", true, 179*time.Second, 3*time.Minute),
+			current:  playback("b", false, 0, 4*time.Minute),
+			elapsed:  2 * time.Second,
+			want:     []events.Type{events.TrackChanged, events.PlaybackPaused},
+		},
+		{
+			name:     "playback stopped",
+			previous: playback("a", true, 179*time.Second, 3*time.Minute),
+			current:  playback("", false, 0, 0),
+			elapsed:  2 * time.Second,
+			want:     []events.Type{events.PlaybackPaused},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := detectChanges(test.previous, test.current, test.elapsed)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("detectChanges() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInterval(t *testing.T) {
+	tests := []struct {
+		name  string
+		state *spotify.CurrentlyPlayingResponse
+		err   error
+		want  time.Duration
+	}{
+		{
+			name:  "playing",
+			state: playback("a", true, 10*time.Second, 3*time.Minute),
+			want:  playingInterval,
+		},
+		{
+			name:  "paused",
+			state: playback("a", false, 10*time.Second, 3*time.Minute),
+			want:  pausedInterval,
+		},
+		{
+			name:  "towards the end of the track",
+			state: playback("a", true, 3*time.Minute-2*time.Second, 3*time.Minute),
+			want:  2*time.Second + endOfTrackDelay,
+		},
+		{
+			name:  "at the end of the track",
+			state: playback("a", true, 3*time.Minute, 3*time.Minute),
+			want:  minInterval,
+		},
+		{
+			name:  "without duration",
+			state: playback("a", true, 10*time.Second, 0),
+			want:  playingInterval,
+		},
+		{
+			name: "error",
+			err:  errors.New("connection reset"),
+			want: errorInterval,
+		},
+		{
+			name: "rate limited shortly",
+			err:  fmt.Errorf("polling: %w", &spotify.RateLimitedError{RetryAfter: 5 * time.Second}),
+			want: errorInterval,
+		},
+		{
+			name: "rate limited for long",
+			err:  fmt.Errorf("polling: %w", &spotify.RateLimitedError{RetryAfter: time.Minute}),
+			want: time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := interval(test.state, test.err); got != test.want {
+				t.Errorf("interval() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtrapolate(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   *spotify.CurrentlyPlayingResponse
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{
+			name:    "playing",
+			state:   playback("a", true, 10*time.Second, 3*time.Minute),
+			elapsed: 1500 * time.Millisecond,
+			want:    11500 * time.Millisecond,
+		},
+		{
+			name:    "paused",
+			state:   playback("a", false, 10*time.Second, 3*time.Minute),
+			elapsed: 5 * time.Second,
+			want:    10 * time.Second,
+		},
+		{
+			name:    "past the end of the track",
+			state:   playback("a", true, 179*time.Second, 3*time.Minute),
+			elapsed: 5 * time.Second,
+			want:    3 * time.Minute,
+		},
+		{
+			name:    "without duration",
+			state:   playback("a", true, 10*time.Second, 0),
+			elapsed: 5 * time.Second,
+			want:    15 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := test.state.ProgressMs
+
+			got := extrapolate(test.state, test.elapsed)
+			if got.ProgressMs != int(test.want.Milliseconds()) {
+				t.Errorf("extrapolate() progress = %dms, want %dms", got.ProgressMs, test.want.Milliseconds())
+			}
+
+			if test.state.ProgressMs != before {
+				t.Error("extrapolate() changed the polled state")
+			}
+		})
+	}
+}
+
+func TestStateIsExtrapolatedToNow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 6, 1, 20, 0, 0, 0, time.UTC)}
+	p := NewPoller(nil, nil, nil, WithClock(clock))
+
+	h := &host{ready: make(chan struct{}), state: playback("a", true, 10*time.Second, 3*time.Minute), fetchedAt: clock.now}
+	close(h.ready)
+
+	clock.now = clock.now.Add(2 * time.Second)
+
+	state, err := p.state(h)
+	if err != nil {
+		t.Fatalf("state() error = %v", err)
+	}
+
+	if state.ProgressMs != 12000 {
+		t.Errorf("state() progress = %dms, want 12000ms", state.ProgressMs)
+	}
+}
@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"errors"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type APITokenRepository struct {
+	db *gorm.DB
+}
+
+func NewAPITokenRepository(db *gorm.DB) *APITokenRepository {
+	return &APITokenRepository{db}
+}
+
+// WithTx returns a copy of the repository that works within the transaction.
+func (a *APITokenRepository) WithTx(tx Tx) *APITokenRepository {
+	return &APITokenRepository{tx.db}
+}
+
+func (a *APITokenRepository) CreateAPIToken(token *models.APIToken) error {
+	return a.db.Create(token).Error
+}
+
+// CreateAPITokenIfMissing creates the token unless a token with the same hash exists already.
+func (a *APITokenRepository) CreateAPITokenIfMissing(token *models.APIToken) error {
+	return a.db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "hash"}}, DoNothing: true}).Create(token).Error
+}
+
+// FindAPITokensByPrefix returns all tokens starting with the given lookup prefix, including revoked
+// and expired ones. The caller has to verify the hash to find the right one.
+func (a *APITokenRepository) FindAPITokensByPrefix(prefix string) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+	err := a.db.Where("prefix = ?", prefix).Find(&tokens).Error
+
+	return tokens, err
+}
+
+func (a *APITokenRepository) FindAPITokensByUser(userID uint) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+	err := a.db.Where("user_id = ?", userID).Order("id").Find(&tokens).Error
+
+	return tokens, err
+}
+
+func (a *APITokenRepository) FindAPIToken(userID, id uint) (*models.APIToken, error) {
+	var token models.APIToken
+	err := a.db.Where("user_id = ?", userID).First(&token, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// UpdateAPIToken stores the secret, expiry and revocation of the token, including empty values.
+func (a *APITokenRepository) UpdateAPIToken(token *models.APIToken) error {
+	return a.db.Model(&models.APIToken{ID: token.ID}).
+		Select("Prefix", "Hash", "ExpiresAt", "RevokedAt", "UpdatedAt").
+		Updates(token).Error
+}
+
+func (a *APITokenRepository) UpdateLastUsedAt(id uint, lastUsedAt time.Time) error {
+	return a.db.Model(&models.APIToken{ID: id}).UpdateColumn("last_used_at", lastUsedAt).Error
+}
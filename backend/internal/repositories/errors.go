@@ -0,0 +1,23 @@
+package repositories
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrNotFound = errors.New("record not found")
+	// ErrDuplicate is returned if a unique index rejects a record, e.g. because a concurrent request
+	// has just created the same one.
+	ErrDuplicate = errors.New("record already exists")
+)
+
+// uniqueViolation is the SQLSTATE Postgres reports if a unique index rejects a row.
+const uniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var pgError *pgconn.PgError
+
+	return errors.As(err, &pgError) && pgError.Code == uniqueViolation
+}
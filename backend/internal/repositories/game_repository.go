@@ -0,0 +1,201 @@
+package repositories
+
+import (
+	"errors"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+type GameRepository struct {
+	db *gorm.DB
+}
+
+func NewGameRepository(db *gorm.DB) *GameRepository {
+	return &GameRepository{db}
+}
+
+// WithTx returns a copy of the repository that works within the transaction.
+func (g *GameRepository) WithTx(tx Tx) *GameRepository {
+	return &GameRepository{tx.db}
+}
+
+func (g *GameRepository) CreateGame(game *models.Game) error {
+	return g.db.Create(game).Error
+}
+
+func (g *GameRepository) UpdateGame(game *models.Game) error {
+	return g.db.Omit("Players", "Rounds").Save(game).Error
+}
+
+func (g *GameRepository) FindGame(id uint) (*models.Game, error) {
+	var game models.Game
+	err := g.db.
+		Preload("Players", func(db *gorm.DB) *gorm.DB { return db.Order("players.id") }).
+		Preload("Players.Cards", func(db *gorm.DB) *gorm.DB {
+			return db.Order("timeline_cards.release_year, timeline_cards.id")
+		}).
+		Preload("Rounds", func(db *gorm.DB) *gorm.DB { return db.Order("rounds.number") }).
+		Preload("Rounds.Guesses", func(db *gorm.DB) *gorm.DB { return db.Order("guesses.id") }).
+		First(&game, id).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &game, nil
+}
+
+// FindGameByJoinCode returns the game the join code has been handed out for, unless the code has expired.
+func (g *GameRepository) FindGameByJoinCode(code string, now time.Time) (*models.Game, error) {
+	var game models.Game
+	err := g.db.Where("join_code = ? AND join_code_expires_at > ?", code, now).First(&game).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return g.FindGame(game.ID)
+}
+
+// SetJoinCode hands out the join code for the game and reports false if another game already has it.
+// A game getting the same code at the same time slips past the check, the unique index rejects it then.
+func (g *GameRepository) SetJoinCode(game *models.Game, code string, expiresAt time.Time) (bool, error) {
+	result := g.db.Model(&models.Game{}).
+		Where("id = ? AND NOT EXISTS (SELECT 1 FROM games WHERE join_code = ?)", game.ID, code).
+		Updates(map[string]any{"join_code": code, "join_code_expires_at": expiresAt})
+
+	if isUniqueViolation(result.Error) {
+		return false, nil
+	}
+
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+// ClearJoinCode makes the join code of the game available to other games again.
+func (g *GameRepository) ClearJoinCode(game *models.Game) error {
+	return g.db.Model(&models.Game{ID: game.ID}).Updates(map[string]any{"join_code": "", "join_code_expires_at": nil}).Error
+}
+
+// ClearExpiredJoinCodes makes the join codes that have expired by now available to other games again.
+func (g *GameRepository) ClearExpiredJoinCodes(now time.Time) error {
+	return g.db.Model(&models.Game{}).
+		Where("join_code <> '' AND join_code_expires_at <= ?", now).
+		Updates(map[string]any{"join_code": "", "join_code_expires_at": nil}).Error
+}
+
+// ExpireGuests lets the API tokens of the guests of the game expire at expiresAt at the latest.
+func (g *GameRepository) ExpireGuests(gameID uint, expiresAt time.Time) error {
+	return g.db.Model(&models.APIToken{}).
+		Where("user_id IN (SELECT id FROM users WHERE guest_game_id = ?)", gameID).
+		Where("expires_at IS NULL OR expires_at > ?", expiresAt).
+		Update("expires_at", expiresAt).Error
+}
+
+// FindGamesByUser returns the games the user hosts or has joined, the latest first.
+func (g *GameRepository) FindGamesByUser(userID uint) ([]models.Game, error) {
+	var games []models.Game
+	err := g.db.
+		Where("user_id = ? OR id IN (SELECT game_id FROM players WHERE user_id = ?)", userID, userID).
+		Order("id DESC").
+		Find(&games).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return games, nil
+}
+
+// CreatePlayer stores the player, ErrDuplicate is returned if its user has joined the game already.
+func (g *GameRepository) CreatePlayer(player *models.Player) error {
+	err := g.db.Create(player).Error
+	if isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+
+	return err
+}
+
+// UpdatePlayerReady stores whether the player is ready to start the game.
+func (g *GameRepository) UpdatePlayerReady(player *models.Player) error {
+	return g.db.Model(&models.Player{ID: player.ID}).Update("ready", player.Ready).Error
+}
+
+// DeletePlayer deletes the player, its guesses and cards are deleted along with it.
+func (g *GameRepository) DeletePlayer(player *models.Player) error {
+	return g.db.Delete(&models.Player{}, player.ID).Error
+}
+
+// CreateCards deals cards to players, e.g. the starting card of a timeline game.
+func (g *GameRepository) CreateCards(cards []models.TimelineCard) error {
+	if len(cards) == 0 {
+		return nil
+	}
+
+	return g.db.Create(&cards).Error
+}
+
+func (g *GameRepository) CreateRound(round *models.Round) error {
+	return g.db.Create(round).Error
+}
+
+// CreateGuess stores the guess, ErrDuplicate is returned if the player has already guessed in the round.
+func (g *GameRepository) CreateGuess(guess *models.Guess) error {
+	err := g.db.Create(guess).Error
+	if isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+
+	return err
+}
+
+// SaveScoring persists the result of a revealed round: the round status, the result of each guess,
+// the cards won and the updated player scores. Everything is written in a single transaction. If the
+// round isn't playing anymore, e.g. because it has been revealed concurrently, ErrNotFound is returned.
+func (g *GameRepository) SaveScoring(round *models.Round, players []models.Player, cards []models.TimelineCard) error {
+	return g.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Round{}).
+			Where("id = ? AND status = ?", round.ID, models.RoundStatusPlaying).
+			Updates(map[string]any{"status": round.Status, "unscored": round.Unscored})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		for _, guess := range round.Guesses {
+			err := tx.Model(&models.Guess{ID: guess.ID}).Updates(map[string]any{"points": guess.Points, "correct": guess.Correct}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(cards) > 0 {
+			if err := tx.Create(&cards).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, player := range players {
+			if err := tx.Model(&models.Player{ID: player.ID}).Update("score", player.Score).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
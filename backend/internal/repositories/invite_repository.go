@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+type InviteRepository struct {
+	db *gorm.DB
+}
+
+func NewInviteRepository(db *gorm.DB) *InviteRepository {
+	return &InviteRepository{db}
+}
+
+// WithTx returns a copy of the repository that works within the transaction.
+func (i *InviteRepository) WithTx(tx Tx) *InviteRepository {
+	return &InviteRepository{tx.db}
+}
+
+func (i *InviteRepository) CreateInvite(invite *models.Invite) error {
+	return i.db.Create(invite).Error
+}
+
+// UseInvite marks the invite as used if it hasn't been used or expired yet, otherwise ErrNotFound
+// is returned. Concurrent requests can't use the same invite twice.
+func (i *InviteRepository) UseInvite(id string) error {
+	now := time.Now()
+	result := i.db.Model(&models.Invite{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", id, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (i *InviteRepository) SetInviteUser(id string, userID uint) error {
+	return i.db.Model(&models.Invite{ID: id}).Update("used_by_user_id", userID).Error
+}
@@ -0,0 +1,45 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type LoginTicketRepository struct {
+	db *gorm.DB
+}
+
+func NewLoginTicketRepository(db *gorm.DB) *LoginTicketRepository {
+	return &LoginTicketRepository{db}
+}
+
+func (l *LoginTicketRepository) CreateLoginTicket(ticket *models.LoginTicket) error {
+	return l.db.Create(ticket).Error
+}
+
+// UseLoginTicket marks the ticket with the given hash as used and returns it. Concurrent requests
+// can't use the same ticket twice, ErrNotFound is returned if it is not usable anymore.
+func (l *LoginTicketRepository) UseLoginTicket(hash string) (*models.LoginTicket, error) {
+	var tickets []models.LoginTicket
+	err := l.db.Model(&tickets).
+		Clauses(clause.Returning{}).
+		Where("hash = ? AND used_at IS NULL AND expires_at > ?", hash, time.Now()).
+		Update("used_at", time.Now()).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tickets) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &tickets[0], nil
+}
+
+// DeleteExpiredLoginTickets removes tickets that expired before the given time.
+func (l *LoginTicketRepository) DeleteExpiredLoginTickets(before time.Time) error {
+	return l.db.Where("expires_at < ?", before).Delete(&models.LoginTicket{}).Error
+}
@@ -0,0 +1,77 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MergeRequestRepository struct {
+	db *gorm.DB
+}
+
+func NewMergeRequestRepository(db *gorm.DB) *MergeRequestRepository {
+	return &MergeRequestRepository{db}
+}
+
+// WithTx returns a copy of the repository that works within the transaction.
+func (m *MergeRequestRepository) WithTx(tx Tx) *MergeRequestRepository {
+	return &MergeRequestRepository{tx.db}
+}
+
+// SaveMergeRequest creates the request or replaces the one the user has raised before.
+func (m *MergeRequestRepository) SaveMergeRequest(request *models.MergeRequest) error {
+	return m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "from_user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"into_user_id", "expires_at", "created_at"}),
+	}).Create(request).Error
+}
+
+// FindMergeRequests returns the requests to merge into the user that haven't expired yet.
+func (m *MergeRequestRepository) FindMergeRequests(intoUserID uint) ([]models.MergeRequest, error) {
+	requests := []models.MergeRequest{}
+	err := m.db.Where("into_user_id = ? AND expires_at > ?", intoUserID, time.Now()).
+		Order("created_at").
+		Find(&requests).Error
+
+	return requests, err
+}
+
+// UseMergeRequest deletes the request to merge into the user and returns it. Concurrent requests
+// can't use the same request twice, ErrNotFound is returned if it is not usable anymore.
+func (m *MergeRequestRepository) UseMergeRequest(id, intoUserID uint) (*models.MergeRequest, error) {
+	var requests []models.MergeRequest
+	err := m.db.Clauses(clause.Returning{}).
+		Where("id = ? AND into_user_id = ? AND expires_at > ?", id, intoUserID, time.Now()).
+		Delete(&requests).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(requests) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &requests[0], nil
+}
+
+// DeleteMergeRequest removes the request to merge into the user, ErrNotFound is returned if there is none.
+func (m *MergeRequestRepository) DeleteMergeRequest(id, intoUserID uint) error {
+	result := m.db.Where("id = ? AND into_user_id = ?", id, intoUserID).Delete(&models.MergeRequest{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpiredMergeRequests removes requests that expired before the given time.
+func (m *MergeRequestRepository) DeleteExpiredMergeRequests(before time.Time) error {
+	return m.db.Where("expires_at < ?", before).Delete(&models.MergeRequest{}).Error
+}
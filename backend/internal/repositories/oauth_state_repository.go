@@ -0,0 +1,45 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OAuthStateRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthStateRepository(db *gorm.DB) *OAuthStateRepository {
+	return &OAuthStateRepository{db}
+}
+
+func (o *OAuthStateRepository) CreateOAuthState(state *models.OAuthState) error {
+	return o.db.Create(state).Error
+}
+
+// UseOAuthState marks the state with the given hash as used and returns it. ErrNotFound is returned
+// if it has been used or expired already.
+func (o *OAuthStateRepository) UseOAuthState(hash string) (*models.OAuthState, error) {
+	var states []models.OAuthState
+	err := o.db.Model(&states).
+		Clauses(clause.Returning{}).
+		Where("hash = ? AND used_at IS NULL AND expires_at > ?", hash, time.Now()).
+		Update("used_at", time.Now()).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(states) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &states[0], nil
+}
+
+// DeleteExpiredOAuthStates removes states that expired before the given time.
+func (o *OAuthStateRepository) DeleteExpiredOAuthStates(before time.Time) error {
+	return o.db.Where("expires_at < ?", before).Delete(&models.OAuthState{}).Error
+}
@@ -0,0 +1,50 @@
+package repositories
+
+import (
+	"errors"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SessionRepository struct {
+	db *gorm.DB
+}
+
+func NewSessionRepository(db *gorm.DB) *SessionRepository {
+	return &SessionRepository{db}
+}
+
+// FindSession returns the session with the given ID unless it has expired.
+func (s *SessionRepository) FindSession(id string) (*models.Session, error) {
+	var session models.Session
+	err := s.db.Where("id = ? AND expires_at > ?", id, time.Now()).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// SaveSession creates the session or replaces its data and expiry.
+func (s *SessionRepository) SaveSession(session *models.Session) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "expires_at", "updated_at"}),
+	}).Create(session).Error
+}
+
+func (s *SessionRepository) DeleteSession(id string) error {
+	return s.db.Delete(&models.Session{ID: id}).Error
+}
+
+// DeleteExpiredSessions removes sessions that expired before the given time.
+func (s *SessionRepository) DeleteExpiredSessions(before time.Time) error {
+	return s.db.Where("expires_at < ?", before).Delete(&models.Session{}).Error
+}
@@ -0,0 +1,24 @@
+package repositories
+
+import "gorm.io/gorm"
+
+// Tx is a database transaction. Repositories take part in it through their WithTx method.
+type Tx struct {
+	db *gorm.DB
+}
+
+// Transactor runs changes spanning several repositories in a single database transaction.
+type Transactor struct {
+	db *gorm.DB
+}
+
+func NewTransactor(db *gorm.DB) *Transactor {
+	return &Transactor{db}
+}
+
+// Transaction commits the transaction if fn returns nil and rolls it back otherwise.
+func (t *Transactor) Transaction(fn func(tx Tx) error) error {
+	return t.db.Transaction(func(db *gorm.DB) error {
+		return fn(Tx{db})
+	})
+}
@@ -2,17 +2,33 @@ package repositories
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
 	"github.com/domnikl/music-box-game/backend/internal/models"
 	"gorm.io/gorm"
 )
 
+// spotifyTokenColumns are stored encrypted, UpdateSpotifyTokens is the only way to change them.
+var spotifyTokenColumns = []string{"SpotifyToken", "SpotifyRefreshToken", "SpotifyTokenKeyID", "SpotifyTokenDataKey"}
+
+var spotifyProfileColumns = []string{"spotify_user_id", "spotify_display_name", "spotify_country", "spotify_product", "spotify_avatar_url"}
+
+// UserRepository stores users. The Spotify tokens of a user are encrypted with a data key of their own,
+// which is wrapped by a key of the keyring; users returned by it carry the decrypted tokens.
 type UserRepository struct {
-	db *gorm.DB
+	db      *gorm.DB
+	keyring *crypto.Keyring
+}
+
+func NewUserRepository(db *gorm.DB, keyring *crypto.Keyring) *UserRepository {
+	return &UserRepository{db, keyring}
 }
 
-func NewUserRepository(db *gorm.DB) *UserRepository {
-	return &UserRepository{db}
+// WithTx returns a copy of the repository that works within the transaction.
+func (u *UserRepository) WithTx(tx Tx) *UserRepository {
+	return &UserRepository{tx.db, u.keyring}
 }
 
 func (u *UserRepository) CreateUser(user *models.User) error {
@@ -25,7 +41,7 @@ func (u *UserRepository) CreateUser(user *models.User) error {
 }
 
 func (u *UserRepository) UpdateUser(user *models.User) error {
-	err := u.db.Updates(user)
+	err := u.db.Omit(spotifyTokenColumns...).Updates(user)
 	if err != nil {
 		return err.Error
 	}
@@ -33,16 +49,260 @@ func (u *UserRepository) UpdateUser(user *models.User) error {
 	return nil
 }
 
-func (u *UserRepository) FindUserByAPIToken(apiToken string) (*models.User, error) {
+// PlaintextAPIToken is an API token that has been stored before tokens were hashed.
+type PlaintextAPIToken struct {
+	UserID   uint
+	APIToken string
+}
+
+func (u *UserRepository) FindPlaintextAPITokens() ([]PlaintextAPIToken, error) {
+	var tokens []PlaintextAPIToken
+	err := u.db.Model(&models.User{}).
+		Select("id AS user_id, api_token").
+		Where("api_token IS NOT NULL").
+		Scan(&tokens).Error
+
+	return tokens, err
+}
+
+// ClearPlaintextAPIToken removes the plaintext API token of the user after it has been hashed.
+func (u *UserRepository) ClearPlaintextAPIToken(userID uint) error {
+	return u.db.Model(&models.User{ID: userID}).UpdateColumn("api_token", nil).Error
+}
+
+func (u *UserRepository) FindUserByID(id uint) (*models.User, error) {
+	var user models.User
+	err := u.db.First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.decryptSpotifyTokens(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdateSpotifyTokens stores the Spotify tokens of the user, including empty values,
+// which UpdateUser would skip.
+func (u *UserRepository) UpdateSpotifyTokens(user *models.User) error {
+	return u.updateSpotifyTokens(u.db, user)
+}
+
+func (u *UserRepository) updateSpotifyTokens(db *gorm.DB, user *models.User) error {
+	encrypted := *user
+	if err := u.encryptSpotifyTokens(&encrypted); err != nil {
+		return err
+	}
+
+	err := db.Model(&models.User{ID: user.ID}).
+		Select(append(spotifyTokenColumns, "SpotifyTokenExpiresAt", "SpotifyLinkBrokenAt")).
+		Updates(&encrypted).Error
+	if err != nil {
+		return err
+	}
+
+	user.SpotifyTokenKeyID = encrypted.SpotifyTokenKeyID
+	user.SpotifyTokenDataKey = encrypted.SpotifyTokenDataKey
+
+	return nil
+}
+
+// FindUserBySpotifyUserID returns the user that has linked the given Spotify account.
+func (u *UserRepository) FindUserBySpotifyUserID(spotifyUserID string) (*models.User, error) {
 	var user models.User
-	err := u.db.Where("api_token = ?", apiToken).First(&user)
-	if err != nil && err.Error != nil {
-		return nil, err.Error
+	err := u.db.Where("spotify_user_id = ?", spotifyUserID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
 	}
 
-	if user.ID == 0 {
-		return nil, errors.New("user not found")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.decryptSpotifyTokens(&user); err != nil {
+		return nil, err
 	}
 
 	return &user, nil
 }
+
+// UpdateSpotifyProfile stores the Spotify profile of the user, including empty values.
+func (u *UserRepository) UpdateSpotifyProfile(user *models.User) error {
+	return u.db.Model(&models.User{ID: user.ID}).
+		Select(spotifyProfileColumns).
+		Updates(user).Error
+}
+
+// MergeUser moves the API tokens and games of user from into user into, which keeps its Spotify tokens
+// and profile. Afterwards, from is deleted. If both users have joined the same game, the player of from
+// stays in the game with its guesses, but isn't linked to a user anymore.
+func (u *UserRepository) MergeUser(from, into *models.User) error {
+	return u.db.Transaction(func(tx *gorm.DB) error {
+		// a user can only have a single player per game
+		joinedByInto := tx.Model(&models.Player{}).Select("game_id").Where("user_id = ?", into.ID)
+		err := tx.Model(&models.Player{}).
+			Where("user_id = ? AND game_id IN (?)", from.ID, joinedByInto).
+			Update("user_id", nil).Error
+		if err != nil {
+			return err
+		}
+
+		for _, model := range []any{&models.APIToken{}, &models.Game{}, &models.Player{}} {
+			if err := tx.Model(model).Where("user_id = ?", from.ID).Update("user_id", into.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&models.User{ID: from.ID}).Error
+	})
+}
+
+// ReencryptSpotifyTokens wraps the data keys of all users with the primary key of the keyring and encrypts
+// tokens that are still stored in plaintext. The tokens themselves stay valid, so nobody needs to link
+// Spotify again. It returns the number of users that have been updated.
+func (u *UserRepository) ReencryptSpotifyTokens() (int, error) {
+	var users []models.User
+	updated := 0
+
+	err := u.db.Where("spotify_token_key_id <> ?", u.keyring.PrimaryID()).
+		FindInBatches(&users, 100, func(tx *gorm.DB, batch int) error {
+			for i := range users {
+				if users[i].SpotifyTokenKeyID == "" && users[i].SpotifyToken == "" && users[i].SpotifyRefreshToken == "" {
+					continue
+				}
+
+				if err := u.reencryptSpotifyTokens(&users[i]); err != nil {
+					return fmt.Errorf("failed to re-encrypt tokens of user %d: %w", users[i].ID, err)
+				}
+
+				updated++
+			}
+
+			return nil
+		}).Error
+
+	return updated, err
+}
+
+func (u *UserRepository) reencryptSpotifyTokens(user *models.User) error {
+	if user.SpotifyTokenKeyID == "" {
+		return u.UpdateSpotifyTokens(user)
+	}
+
+	wrapped, err := u.keyring.Rewrap(
+		crypto.WrappedKey{KeyID: user.SpotifyTokenKeyID, Ciphertext: user.SpotifyTokenDataKey},
+		spotifyTokenAAD(user.ID, "spotify_token_data_key"),
+	)
+	if err != nil {
+		return err
+	}
+
+	return u.db.Model(&models.User{ID: user.ID}).UpdateColumns(map[string]any{
+		"spotify_token_key_id":   wrapped.KeyID,
+		"spotify_token_data_key": wrapped.Ciphertext,
+	}).Error
+}
+
+func (u *UserRepository) encryptSpotifyTokens(user *models.User) error {
+	if user.SpotifyToken == "" && user.SpotifyRefreshToken == "" {
+		user.SpotifyTokenKeyID = ""
+		user.SpotifyTokenDataKey = ""
+
+		return nil
+	}
+
+	dataKey, wrapped, err := u.keyring.GenerateDataKey(spotifyTokenAAD(user.ID, "spotify_token_data_key"))
+	if err != nil {
+		return err
+	}
+
+	if user.SpotifyToken, err = crypto.Encrypt(dataKey, user.SpotifyToken, spotifyTokenAAD(user.ID, "spotify_token")); err != nil {
+		return err
+	}
+
+	if user.SpotifyRefreshToken, err = crypto.Encrypt(dataKey, user.SpotifyRefreshToken, spotifyTokenAAD(user.ID, "spotify_refresh_token")); err != nil {
+		return err
+	}
+
+	user.SpotifyTokenKeyID = wrapped.KeyID
+	user.SpotifyTokenDataKey = wrapped.Ciphertext
+
+	return nil
+}
+
+// spotifyTokenAAD is the additional data the Spotify tokens of a user are encrypted with. It binds them
+// to the user and column, so ciphertexts copied to another user or swapped between columns can't be decrypted.
+func spotifyTokenAAD(userID uint, column string) []byte {
+	return fmt.Appendf(nil, "users/%d/%s", userID, column)
+}
+
+// decryptSpotifyTokens decrypts the tokens of a user read from the database. Tokens stored before
+// encryption was introduced have no key ID and are returned as they are.
+func (u *UserRepository) decryptSpotifyTokens(user *models.User) error {
+	if user.SpotifyTokenKeyID == "" {
+		return nil
+	}
+
+	dataKey, err := u.keyring.UnwrapDataKey(
+		crypto.WrappedKey{KeyID: user.SpotifyTokenKeyID, Ciphertext: user.SpotifyTokenDataKey},
+		spotifyTokenAAD(user.ID, "spotify_token_data_key"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt Spotify tokens of user %d: %w", user.ID, err)
+	}
+
+	if user.SpotifyToken, err = crypto.Decrypt(dataKey, user.SpotifyToken, spotifyTokenAAD(user.ID, "spotify_token")); err != nil {
+		return fmt.Errorf("failed to decrypt Spotify token of user %d: %w", user.ID, err)
+	}
+
+	if user.SpotifyRefreshToken, err = crypto.Decrypt(dataKey, user.SpotifyRefreshToken, spotifyTokenAAD(user.ID, "spotify_refresh_token")); err != nil {
+		return fmt.Errorf("failed to decrypt Spotify refresh token of user %d: %w", user.ID, err)
+	}
+
+	return nil
+}
+
+// UpgradeGuest removes the game a guest is scoped to, which makes it a full user, and stores the source
+// it has been upgraded by.
+func (u *UserRepository) UpgradeGuest(user *models.User, source string) error {
+	return u.db.Model(&models.User{ID: user.ID}).
+		Updates(map[string]any{"guest_game_id": nil, "created_via": source}).Error
+}
+
+// DeleteGuests deletes guests whose API tokens have all expired or been revoked, and guests of games that
+// have been deleted, have finished before finishedBefore or have been idle since idleBefore. Their players
+// stay in the game without a user, so the scores don't change.
+func (u *UserRepository) DeleteGuests(now, finishedBefore, idleBefore time.Time) error {
+	return u.db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Unscoped().Model(&models.User{}).
+			Joins("LEFT JOIN games ON games.id = users.guest_game_id").
+			Where("users.guest_game_id IS NOT NULL").
+			Where(tx.Where("NOT EXISTS (SELECT 1 FROM api_tokens WHERE api_tokens.user_id = users.id AND api_tokens.revoked_at IS NULL AND (api_tokens.expires_at IS NULL OR api_tokens.expires_at > ?))", now).
+				Or("games.id IS NULL OR games.deleted_at IS NOT NULL").
+				Or("games.status = ? AND games.updated_at < ?", models.GameStatusFinished, finishedBefore).
+				Or("GREATEST(games.updated_at, (SELECT MAX(rounds.created_at) FROM rounds WHERE rounds.game_id = games.id)) < ?", idleBefore)).
+			Pluck("users.id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if err := tx.Model(&models.Player{}).Where("user_id IN ?", ids).Update("user_id", nil).Error; err != nil {
+			return err
+		}
+
+		// their API tokens and sessions are deleted along with them
+		return tx.Unscoped().Delete(&models.User{}, ids).Error
+	})
+}
+
+// UpdatePreferredDevice stores the preferred device of the user, which may be empty to unset it.
+func (u *UserRepository) UpdatePreferredDevice(user *models.User) error {
+	return u.db.Model(&models.User{ID: user.ID}).Update("preferred_device_id", user.PreferredDeviceID).Error
+}
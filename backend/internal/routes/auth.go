@@ -2,16 +2,51 @@ package routes
 
 import (
 	"github.com/domnikl/music-box-game/backend/internal/controllers"
-	"github.com/domnikl/music-box-game/backend/internal/repositories"
+	"github.com/domnikl/music-box-game/backend/internal/middlewares"
 	"github.com/domnikl/music-box-game/backend/internal/services"
 	"github.com/labstack/echo/v4"
-	"gorm.io/gorm"
 )
 
-func setupAuth(e *echo.Echo, db *gorm.DB) {
-	userService := services.NewUserService(repositories.NewUserRepository(db))
-	authController := controllers.NewAuthController(userService)
+// RegistrationLimits limit how many users can be created per client IP and in total, and how many guests
+// can join per join code and in total. Guests of a game often share an IP, e.g. in the Wi-Fi of a party.
+type RegistrationLimits struct {
+	PerIP        middlewares.RateLimit
+	Global       middlewares.RateLimit
+	GuestPerCode middlewares.RateLimit
+	GuestGlobal  middlewares.RateLimit
+}
+
+func setupAuth(
+	e *echo.Echo,
+	apiUserAuthMiddleware middlewares.APIUserAuthMiddleware,
+	apiTokenService *services.APITokenService,
+	registrationService *services.RegistrationService,
+	limits RegistrationLimits,
+) {
+	authController := controllers.NewAuthController(registrationService)
+	apiTokenController := controllers.NewAPITokenController(apiTokenService)
+
+	e.POST("/auth", authController.InitAuth,
+		middlewares.PerIPRateLimit(limits.PerIP),
+		middlewares.GlobalRateLimit(limits.Global),
+	)
+
+	// guests join a single game with its join code instead of registering
+	e.POST("/auth/guest", authController.GuestAuth,
+		middlewares.PerJoinCodeRateLimit(limits.GuestPerCode),
+		middlewares.GlobalRateLimit(limits.GuestGlobal),
+	)
+
+	e.POST("/auth/upgrade", authController.Upgrade,
+		apiUserAuthMiddleware.IsAuthenticated,
+		middlewares.PerIPRateLimit(limits.PerIP),
+		middlewares.GlobalRateLimit(limits.Global),
+	)
 
-	// TODO: secure this endpoint with a hardcoded secret
-	e.POST("/auth", authController.InitAuth)
+	g := e.Group("/auth/tokens")
+	g.Use(apiUserAuthMiddleware.IsAuthenticated, apiUserAuthMiddleware.NoGuests)
+	g.GET("", apiTokenController.GetTokens)
+	g.POST("", apiTokenController.CreateToken)
+	g.POST("/:id/rotate", apiTokenController.RotateToken)
+	g.DELETE("/:id", apiTokenController.RevokeToken)
 }
@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"github.com/domnikl/music-box-game/backend/internal/controllers"
+	"github.com/domnikl/music-box-game/backend/internal/middlewares"
+	"github.com/domnikl/music-box-game/backend/internal/nowplaying"
+	"github.com/domnikl/music-box-game/backend/internal/services"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+	"github.com/labstack/echo/v4"
+)
+
+func setupGames(
+	e *echo.Echo,
+	apiUserAuthMiddleware middlewares.APIUserAuthMiddleware,
+	gameService *services.GameService,
+	apiTokenService *services.APITokenService,
+	poller *nowplaying.Poller,
+	spotify *spotify.Spotify,
+	releaseYearService *services.ReleaseYearService,
+) {
+	spotifyMiddleware := middlewares.NewSpotifyMiddleware()
+
+	controller := controllers.NewGameController(gameService, releaseYearService, spotify, poller)
+	eventsController := controllers.NewGameEventsController(gameService, apiTokenService, poller)
+
+	// WebSocket connections authenticate themselves, see GameEventsController.WebSocket
+	e.GET("/games/:id/ws", eventsController.WebSocket)
+
+	g := e.Group("/games")
+	g.Use(apiUserAuthMiddleware.IsAuthenticated)
+	g.GET("", controller.GetGames)
+	g.POST("", controller.CreateGame)
+	g.POST("/join", controller.JoinGame)
+	g.GET("/:id", controller.GetGame)
+	g.GET("/:id/events", eventsController.Stream)
+	g.GET("/:id/playback", controller.Playback)
+	g.POST("/:id/join-code", controller.CreateJoinCode)
+	g.POST("/:id/host", controller.HandOffHost)
+	g.POST("/:id/players", controller.AddPlayer)
+	g.DELETE("/:id/players/:playerId", controller.RemovePlayer)
+	g.PUT("/:id/players/:playerId/ready", controller.SetReady)
+	g.POST("/:id/guesses", controller.SubmitGuess)
+	g.POST("/:id/reveal", controller.Reveal)
+	g.POST("/:id/finish", controller.Finish)
+
+	needsSpotifyToken := g.Group("")
+	needsSpotifyToken.Use(spotifyMiddleware.HasToken)
+	needsSpotifyToken.POST("/:id/rounds", controller.StartRound)
+	needsSpotifyToken.POST("/:id/play", controller.Play)
+	needsSpotifyToken.POST("/:id/pause", controller.Pause)
+}
@@ -1,12 +1,38 @@
 package routes
 
 import (
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/middlewares"
+	"github.com/domnikl/music-box-game/backend/internal/nowplaying"
+	"github.com/domnikl/music-box-game/backend/internal/services"
 	"github.com/domnikl/music-box-game/backend/internal/spotify"
 	"github.com/labstack/echo/v4"
-	"gorm.io/gorm"
 )
 
-func Setup(e *echo.Echo, db *gorm.DB, spotify *spotify.Spotify) {
-	setupAuth(e, db)
-	setupSpotify(e, db, spotify)
+type Config struct {
+	RegistrationLimits RegistrationLimits
+	// AllowQueryAPIToken accepts API tokens in the api_token query parameter next to the Authorization header.
+	AllowQueryAPIToken bool
+}
+
+func Setup(
+	e *echo.Echo,
+	config Config,
+	userService *services.UserService,
+	apiTokenService *services.APITokenService,
+	loginTicketService *services.LoginTicketService,
+	registrationService *services.RegistrationService,
+	gameService *services.GameService,
+	hub *events.Hub,
+	spotify *spotify.Spotify,
+	releaseYearService *services.ReleaseYearService,
+) {
+	apiUserAuthMiddleware := middlewares.NewAPIUserAuthMiddleware(apiTokenService, config.AllowQueryAPIToken)
+
+	setupAuth(e, apiUserAuthMiddleware, apiTokenService, registrationService, config.RegistrationLimits)
+	// one poller for all routes, so every host is only polled once
+	poller := nowplaying.NewPoller(spotify, userService, hub)
+
+	setupSpotify(e, apiUserAuthMiddleware, userService, loginTicketService, spotify, poller)
+	setupGames(e, apiUserAuthMiddleware, gameService, apiTokenService, poller, spotify, releaseYearService)
 }
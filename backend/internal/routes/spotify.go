@@ -3,33 +3,45 @@ package routes
 import (
 	"github.com/domnikl/music-box-game/backend/internal/controllers"
 	"github.com/domnikl/music-box-game/backend/internal/middlewares"
-	"github.com/domnikl/music-box-game/backend/internal/repositories"
+	"github.com/domnikl/music-box-game/backend/internal/nowplaying"
 	"github.com/domnikl/music-box-game/backend/internal/services"
 	"github.com/domnikl/music-box-game/backend/internal/spotify"
 	"github.com/labstack/echo/v4"
-	"gorm.io/gorm"
 )
 
 var token string
 
-func setupSpotify(e *echo.Echo, db *gorm.DB, spotify *spotify.Spotify) {
-	userRepository := repositories.NewUserRepository(db)
-	apiUserAuthMiddleware := middlewares.NewAPIUserAuthMiddleware(userRepository)
+func setupSpotify(
+	e *echo.Echo,
+	apiUserAuthMiddleware middlewares.APIUserAuthMiddleware,
+	userService *services.UserService,
+	loginTicketService *services.LoginTicketService,
+	spotify *spotify.Spotify,
+	poller *nowplaying.Poller,
+) {
 	spotifyMiddleware := middlewares.NewSpotifyMiddleware()
 
-	userService := services.NewUserService(userRepository)
-	controller := controllers.NewSpotifyController(userService, spotify)
+	controller := controllers.NewSpotifyController(userService, loginTicketService, spotify, poller)
+
+	// opened in the browser, the login ticket identifies the user instead of the API token
+	e.GET("/spotify/auth", controller.Auth)
+	e.GET("/spotify/callback", controller.Callback)
 
 	g := e.Group("/spotify")
-	g.Use(apiUserAuthMiddleware.IsAuthenticated)
-	g.GET("/auth", controller.Auth)
-	g.GET("/callback", controller.Callback)
+	g.Use(apiUserAuthMiddleware.IsAuthenticated, apiUserAuthMiddleware.NoGuests)
+	g.POST("/login-tickets", controller.CreateLoginTicket)
+	g.DELETE("/link", controller.Unlink)
+	g.GET("/merge-requests", controller.GetMergeRequests)
+	g.POST("/merge-requests/:id/accept", controller.AcceptMergeRequest)
+	g.DELETE("/merge-requests/:id", controller.DeclineMergeRequest)
 
 	needsSpotifyToken := g.Group("")
 	needsSpotifyToken.Use(spotifyMiddleware.HasToken)
+	needsSpotifyToken.GET("/profile", controller.GetProfile)
 	needsSpotifyToken.GET("/playlists", controller.GetPlaylists)
 	needsSpotifyToken.GET("/playlists/:id", controller.GetPlaylist)
 	needsSpotifyToken.GET("/devices", controller.GetDevices)
+	needsSpotifyToken.PUT("/devices/preferred", controller.SetPreferredDevice)
 	needsSpotifyToken.GET("/currently-playing", controller.GetCurrentlyPlaying)
 	needsSpotifyToken.POST("/player/next", controller.Next)
 	needsSpotifyToken.POST("/player/pause", controller.Pause)
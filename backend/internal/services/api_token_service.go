@@ -0,0 +1,223 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/repositories"
+)
+
+const (
+	// DefaultAPITokenName names tokens created without a name, e.g. on registration.
+	DefaultAPITokenName   = "Default"
+	maxAPITokenNameLength = 64
+
+	// last use of a token is only stored if the previous one is older than this
+	lastUsedResolution = time.Minute
+)
+
+var (
+	ErrInvalidAPIToken     = errors.New("invalid API token")
+	ErrInvalidAPITokenName = errors.New("API token name must be at most 64 characters")
+	ErrAPITokenNotFound    = errors.New("API token not found")
+	ErrAPITokenRevoked     = errors.New("API token has been revoked")
+)
+
+type APITokenService struct {
+	repository     *repositories.APITokenRepository
+	userRepository *repositories.UserRepository
+	hasher         *crypto.TokenHasher
+}
+
+func NewAPITokenService(repository *repositories.APITokenRepository, userRepository *repositories.UserRepository, hasher *crypto.TokenHasher) *APITokenService {
+	return &APITokenService{repository, userRepository, hasher}
+}
+
+// WithTx returns a copy of the service that works within the transaction.
+func (a *APITokenService) WithTx(tx repositories.Tx) *APITokenService {
+	return &APITokenService{a.repository.WithTx(tx), a.userRepository.WithTx(tx), a.hasher}
+}
+
+// CreateToken creates a new API token for the user. Only the hash of the token is stored, so the
+// returned plaintext token can't be retrieved again later. Without expiresAt, the token never expires.
+func (a *APITokenService) CreateToken(user *models.User, name string, expiresAt *time.Time) (*models.APIToken, string, error) {
+	if name == "" {
+		name = DefaultAPITokenName
+	}
+
+	if utf8.RuneCountInString(name) > maxAPITokenNameLength {
+		return nil, "", ErrInvalidAPITokenName
+	}
+
+	token := &models.APIToken{UserID: user.ID, Name: name, ExpiresAt: expiresAt}
+
+	plaintext, err := a.newSecret(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := a.repository.CreateAPIToken(token); err != nil {
+		return nil, "", err
+	}
+
+	return token, plaintext, nil
+}
+
+// Authenticate returns the user the API token belongs to along with the token itself. Revoked and
+// expired tokens are rejected with ErrInvalidAPIToken, just like unknown ones.
+func (a *APITokenService) Authenticate(plaintext string) (*models.User, *models.APIToken, error) {
+	tokens, err := a.repository.FindAPITokensByPrefix(crypto.LookupPrefix(plaintext))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	for i := range tokens {
+		token := &tokens[i]
+		if !a.hasher.Verify(plaintext, token.Hash) {
+			continue
+		}
+
+		if !token.Valid(now) {
+			return nil, nil, ErrInvalidAPIToken
+		}
+
+		user, err := a.userRepository.FindUserByID(token.UserID)
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, nil, ErrInvalidAPIToken
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedResolution {
+			token.LastUsedAt = &now
+			if err := a.repository.UpdateLastUsedAt(token.ID, now); err != nil {
+				slog.Warn("Failed to store last use of API token: " + err.Error())
+			}
+		}
+
+		return user, token, nil
+	}
+
+	return nil, nil, ErrInvalidAPIToken
+}
+
+// CheckToken returns ErrInvalidAPIToken if the token has been revoked, rotated or has expired since it
+// has been used to authenticate, e.g. by a long-lived connection.
+func (a *APITokenService) CheckToken(token *models.APIToken) error {
+	current, err := a.repository.FindAPIToken(token.UserID, token.ID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return ErrInvalidAPIToken
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if current.Hash != token.Hash || !current.Valid(time.Now()) {
+		return ErrInvalidAPIToken
+	}
+
+	return nil
+}
+
+func (a *APITokenService) FindTokens(user *models.User) ([]models.APIToken, error) {
+	return a.repository.FindAPITokensByUser(user.ID)
+}
+
+// RotateToken replaces the secret of the token, the previous one stops working immediately.
+func (a *APITokenService) RotateToken(user *models.User, id uint) (*models.APIToken, string, error) {
+	token, err := a.findToken(user, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if token.RevokedAt != nil {
+		return nil, "", ErrAPITokenRevoked
+	}
+
+	plaintext, err := a.newSecret(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := a.repository.UpdateAPIToken(token); err != nil {
+		return nil, "", err
+	}
+
+	return token, plaintext, nil
+}
+
+// RevokeToken revokes the token for good, revoking it again has no effect.
+func (a *APITokenService) RevokeToken(user *models.User, id uint) error {
+	token, err := a.findToken(user, id)
+	if err != nil {
+		return err
+	}
+
+	if token.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	token.RevokedAt = &now
+
+	return a.repository.UpdateAPIToken(token)
+}
+
+// HashPlaintextAPITokens moves API tokens that have been stored in plaintext on the users into hashed
+// API tokens. Users keep their tokens, so the app doesn't need to authenticate again.
+func (a *APITokenService) HashPlaintextAPITokens() (int, error) {
+	tokens, err := a.userRepository.FindPlaintextAPITokens()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, plaintext := range tokens {
+		token := &models.APIToken{
+			UserID: plaintext.UserID,
+			Name:   DefaultAPITokenName,
+			Prefix: crypto.LookupPrefix(plaintext.APIToken),
+			Hash:   a.hasher.Hash(plaintext.APIToken),
+		}
+
+		if err := a.repository.CreateAPITokenIfMissing(token); err != nil {
+			return 0, fmt.Errorf("failed to hash API token of user %d: %w", plaintext.UserID, err)
+		}
+
+		if err := a.userRepository.ClearPlaintextAPIToken(plaintext.UserID); err != nil {
+			return 0, fmt.Errorf("failed to hash API token of user %d: %w", plaintext.UserID, err)
+		}
+	}
+
+	return len(tokens), nil
+}
+
+func (a *APITokenService) findToken(user *models.User, id uint) (*models.APIToken, error) {
+	token, err := a.repository.FindAPIToken(user.ID, id)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, ErrAPITokenNotFound
+	}
+
+	return token, err
+}
+
+// newSecret generates a new secret for the token and returns it in plaintext.
+func (a *APITokenService) newSecret(token *models.APIToken) (string, error) {
+	plaintext, err := crypto.NewAPIToken()
+	if err != nil {
+		return "", err
+	}
+
+	token.Prefix = crypto.LookupPrefix(plaintext)
+	token.Hash = a.hasher.Hash(plaintext)
+
+	return plaintext, nil
+}
@@ -0,0 +1,912 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"github.com/domnikl/music-box-game/backend/internal/events"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/repositories"
+)
+
+const (
+	defaultMaxRounds = 10
+
+	joinCodeLength = 5
+	// joinCodeCharset leaves out characters that are easily mixed up, like 0 and O or 1, I and L
+	joinCodeCharset = "ABCDEFGHJKMNPQRSTUVWXYZ"
+	joinCodeTTL     = 30 * time.Minute
+	// joinCodeAttempts is how often a new code is generated if the previous one is taken by another game
+	joinCodeAttempts = 5
+
+	maxNicknameLength = 24
+
+	// GuestTTL is how long guests can take part in a game at most.
+	GuestTTL = 24 * time.Hour
+	// guestGracePeriod is how long guests can still look at the results once the game has finished.
+	guestGracePeriod = time.Hour
+	// guestIdleTimeout is how long a game can go without a new round before its guests are deleted.
+	guestIdleTimeout = 2 * time.Hour
+)
+
+var (
+	ErrGameNotFound     = errors.New("game not found")
+	ErrGameFinished     = errors.New("game is already finished")
+	ErrPlayerNotFound   = errors.New("player not found")
+	ErrRoundNotFinished = errors.New("current round has not been revealed yet")
+	ErrNoRoundPlaying   = errors.New("no round is currently playing")
+	ErrAlreadyGuessed   = errors.New("player has already guessed in this round")
+	ErrNoTracksLeft     = errors.New("no tracks left to play")
+	ErrNotEnoughPlayers = errors.New("game needs at least one player")
+	ErrInvalidGameMode  = errors.New("invalid game mode")
+	ErrInvalidPlayback  = errors.New("invalid playback, must be remote or host_device")
+	ErrInvalidPosition  = errors.New("invalid position in timeline")
+	ErrNotGameHost      = errors.New("only the host of the game can do this")
+	ErrForeignPlayer    = errors.New("players can only act for themselves")
+	ErrGameStarted      = errors.New("game has already started")
+	ErrInvalidJoinCode  = errors.New("invalid or expired join code")
+	ErrInvalidNickname  = errors.New("nickname must be between 1 and 24 characters")
+	ErrNicknameTaken    = errors.New("nickname is already taken in this game")
+	ErrPlayersNotReady  = errors.New("not all players are ready")
+	ErrHostNeedsSpotify = errors.New("the new host needs to have Spotify linked")
+	ErrGuestNotAllowed  = errors.New("guests can only take part in the game they have joined")
+)
+
+type GameSettings struct {
+	PlaylistID  string
+	Mode        string
+	Playback    string
+	MaxRounds   int
+	TargetCards int
+}
+
+type GameService struct {
+	repository  *repositories.GameRepository
+	userService *UserService
+	hub         *events.Hub
+	transactor  *repositories.Transactor
+}
+
+func NewGameService(repository *repositories.GameRepository, userService *UserService, hub *events.Hub, transactor *repositories.Transactor) *GameService {
+	return &GameService{repository, userService, hub, transactor}
+}
+
+func (g *GameService) CreateGame(user *models.User, settings GameSettings) (*models.Game, error) {
+	if user.IsGuest() {
+		return nil, ErrGuestNotAllowed
+	}
+
+	game := &models.Game{
+		UserID:     user.ID,
+		PlaylistID: settings.PlaylistID,
+		Status:     models.GameStatusCreated,
+		Mode:       settings.Mode,
+		Playback:   settings.Playback,
+		MaxRounds:  settings.MaxRounds,
+	}
+
+	switch game.Playback {
+	case "":
+		// hosts with Spotify Free can't control playback, so their app has to play the tracks
+		game.Playback = models.GamePlaybackRemote
+		if user.SpotifyPremiumRequired() {
+			game.Playback = models.GamePlaybackHostDevice
+		}
+	case models.GamePlaybackRemote, models.GamePlaybackHostDevice:
+	default:
+		return nil, ErrInvalidPlayback
+	}
+
+	switch game.Mode {
+	case "", models.GameModeClassic:
+		game.Mode = models.GameModeClassic
+		if game.MaxRounds <= 0 {
+			game.MaxRounds = defaultMaxRounds
+		}
+	case models.GameModeTimeline:
+		// timeline games end when someone reaches the target, MaxRounds is an optional upper limit
+		game.TargetCards = settings.TargetCards
+		if game.TargetCards <= 0 {
+			game.TargetCards = defaultTargetCards
+		}
+	default:
+		return nil, ErrInvalidGameMode
+	}
+
+	if err := g.repository.CreateGame(game); err != nil {
+		return nil, err
+	}
+
+	return game, nil
+}
+
+// FindGame returns the game with the given ID, but only if the user hosts it or has joined it.
+func (g *GameService) FindGame(user *models.User, id uint) (*models.Game, error) {
+	game, err := g.repository.FindGame(id)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, ErrGameNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !game.IsHost(user.ID) && game.FindPlayerByUser(user.ID) == nil {
+		return nil, ErrGameNotFound
+	}
+
+	return game, nil
+}
+
+// FindGames returns the games the user hosts or has joined.
+func (g *GameService) FindGames(user *models.User) ([]models.Game, error) {
+	return g.repository.FindGamesByUser(user.ID)
+}
+
+// AddPlayer adds a player without a user to the game, e.g. for somebody playing along on the host's
+// phone. Names are checked like the nicknames of players who join themselves.
+func (g *GameService) AddPlayer(game *models.Game, name string) (*models.Player, error) {
+	if game.Status == models.GameStatusFinished {
+		return nil, ErrGameFinished
+	}
+
+	name, err := checkNickname(game, name)
+	if err != nil {
+		return nil, err
+	}
+
+	player := &models.Player{GameID: game.ID, Name: name}
+	if err := g.repository.CreatePlayer(player); err != nil {
+		return nil, err
+	}
+
+	g.playerJoined(game, player)
+
+	return player, nil
+}
+
+// CreateJoinCode hands out a new join code other users can join the game with from the lobby, replacing
+// the previous one. Codes expire after a while and once the game has started.
+func (g *GameService) CreateJoinCode(game *models.Game) error {
+	if game.Status != models.GameStatusCreated {
+		return ErrGameStarted
+	}
+
+	now := time.Now()
+
+	// expired codes would otherwise block new games from getting them
+	if err := g.repository.ClearExpiredJoinCodes(now); err != nil {
+		return err
+	}
+
+	expiresAt := now.Add(joinCodeTTL)
+
+	for range joinCodeAttempts {
+		code, err := crypto.StringWithCharset(joinCodeLength, joinCodeCharset)
+		if err != nil {
+			return err
+		}
+
+		ok, err := g.repository.SetJoinCode(game, code, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			game.JoinCode = code
+			game.JoinCodeExpiresAt = &expiresAt
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to find an unused join code after %d attempts", joinCodeAttempts)
+}
+
+// JoinGame adds the user to the game with the join code as a player with the given nickname. Users who
+// have joined the game already get their player back.
+func (g *GameService) JoinGame(user *models.User, code, nickname string) (*models.Game, *models.Player, error) {
+	game, err := g.findGameByJoinCode(code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.IsGuest() && *user.GuestGameID != game.ID {
+		return nil, nil, ErrGuestNotAllowed
+	}
+
+	if player := game.FindPlayerByUser(user.ID); player != nil {
+		return game, player, nil
+	}
+
+	nickname, err = checkNickname(game, nickname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	player, err := g.addJoinedPlayer(game, user, nickname)
+	if errors.Is(err, repositories.ErrDuplicate) {
+		// the user has joined concurrently, e.g. because the request has been retried
+		return g.joinedPlayer(game.ID, user)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return game, player, nil
+}
+
+// joinedPlayer returns the game with the player the user has joined it with.
+func (g *GameService) joinedPlayer(gameID uint, user *models.User) (*models.Game, *models.Player, error) {
+	game, err := g.repository.FindGame(gameID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	player := game.FindPlayerByUser(user.ID)
+	if player == nil {
+		return nil, nil, ErrPlayerNotFound
+	}
+
+	return game, player, nil
+}
+
+// JoinAsGuest creates a guest who can only take part in the game with the join code and adds it to the
+// game as a player with the given nickname. issueToken is called within the same transaction, so either
+// the guest, its player and its token are created, or none of them.
+func (g *GameService) JoinAsGuest(code, nickname string, issueToken func(tx repositories.Tx, guest *models.User) error) (*models.User, *models.Game, *models.Player, error) {
+	game, err := g.findGameByJoinCode(code)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if game.Status != models.GameStatusCreated {
+		return nil, nil, nil, ErrGameStarted
+	}
+
+	nickname, err = checkNickname(game, nickname)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var guest *models.User
+	var player *models.Player
+
+	err = g.transactor.Transaction(func(tx repositories.Tx) error {
+		guest, err = g.userService.WithTx(tx).CreateGuest(game.ID)
+		if err != nil {
+			return err
+		}
+
+		player = &models.Player{GameID: game.ID, UserID: &guest.ID, Name: nickname}
+		if err := g.repository.WithTx(tx).CreatePlayer(player); err != nil {
+			return err
+		}
+
+		return issueToken(tx, guest)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	g.playerJoined(game, player)
+
+	return guest, game, player, nil
+}
+
+// findGameByJoinCode returns the game of the join code, which has to be in the lobby still.
+func (g *GameService) findGameByJoinCode(code string) (*models.Game, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != joinCodeLength {
+		return nil, ErrInvalidJoinCode
+	}
+
+	game, err := g.repository.FindGameByJoinCode(code, time.Now())
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, ErrInvalidJoinCode
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return game, nil
+}
+
+func (g *GameService) addJoinedPlayer(game *models.Game, user *models.User, nickname string) (*models.Player, error) {
+	if game.Status != models.GameStatusCreated {
+		return nil, ErrGameStarted
+	}
+
+	player := &models.Player{GameID: game.ID, UserID: &user.ID, Name: nickname}
+	if err := g.repository.CreatePlayer(player); err != nil {
+		return nil, err
+	}
+
+	g.playerJoined(game, player)
+
+	return player, nil
+}
+
+// playerJoined adds the player who has just joined to the game and tells everybody about it.
+func (g *GameService) playerJoined(game *models.Game, player *models.Player) {
+	game.Players = append(game.Players, *player)
+	g.hub.Publish(game.ID, events.PlayerJoined, events.PlayerData{Player: *player})
+}
+
+// SetReady tells the lobby whether the user's player is ready for the game to start.
+func (g *GameService) SetReady(user *models.User, game *models.Game, playerID uint, ready bool) (*models.Player, error) {
+	if game.Status != models.GameStatusCreated {
+		return nil, ErrGameStarted
+	}
+
+	player := game.FindPlayer(playerID)
+	if player == nil {
+		return nil, ErrPlayerNotFound
+	}
+
+	if player.UserID == nil || *player.UserID != user.ID {
+		return nil, ErrForeignPlayer
+	}
+
+	player.Ready = ready
+	if err := g.repository.UpdatePlayerReady(player); err != nil {
+		return nil, err
+	}
+
+	g.hub.Publish(game.ID, events.PlayerReady, events.PlayerData{Player: *player})
+
+	return player, nil
+}
+
+// RemovePlayer removes the player from a game that hasn't finished yet, along with its guesses and cards.
+// The host can kick any player, everybody else can only leave the game themselves.
+func (g *GameService) RemovePlayer(user *models.User, game *models.Game, playerID uint) error {
+	if game.Status == models.GameStatusFinished {
+		return ErrGameFinished
+	}
+
+	player := game.FindPlayer(playerID)
+	if player == nil {
+		return ErrPlayerNotFound
+	}
+
+	leaving := player.UserID != nil && *player.UserID == user.ID
+	if !leaving && !game.IsHost(user.ID) {
+		return ErrNotGameHost
+	}
+
+	if err := g.repository.DeletePlayer(player); err != nil {
+		return err
+	}
+
+	removed := *player
+	game.Players = slices.DeleteFunc(game.Players, func(p models.Player) bool { return p.ID == playerID })
+	g.hub.Publish(game.ID, events.PlayerLeft, events.PlayerData{Player: removed, Kicked: !leaving})
+
+	return nil
+}
+
+// HandOffHost makes the user of the player the new host of the game. Playback moves to the new host's
+// Spotify account, so they need to have linked it. The previous host keeps access to the game as a
+// player, one is added for them if they haven't joined it themselves.
+func (g *GameService) HandOffHost(game *models.Game, playerID uint) (*models.Player, error) {
+	if game.Status == models.GameStatusFinished {
+		return nil, ErrGameFinished
+	}
+
+	player := game.FindPlayer(playerID)
+	if player == nil {
+		return nil, ErrPlayerNotFound
+	}
+
+	// players added by name don't have a user who could host the game
+	if player.UserID == nil {
+		return nil, ErrHostNeedsSpotify
+	}
+
+	host, err := g.userService.FindUser(*player.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !host.SpotifyLinked() {
+		return nil, ErrHostNeedsSpotify
+	}
+
+	previousHost := game.UserID
+	var added *models.Player
+
+	err = g.transactor.Transaction(func(tx repositories.Tx) error {
+		repository := g.repository.WithTx(tx)
+
+		if game.FindPlayerByUser(previousHost) == nil {
+			if added, err = g.addPreviousHostPlayer(repository, game); err != nil {
+				return err
+			}
+		}
+
+		game.UserID = host.ID
+
+		return repository.UpdateGame(game)
+	})
+	if err != nil {
+		game.UserID = previousHost
+		return nil, err
+	}
+
+	if added != nil {
+		g.playerJoined(game, added)
+	}
+
+	g.hub.Publish(game.ID, events.HostChanged, events.HostData{UserID: host.ID, PlayerID: player.ID})
+
+	return player, nil
+}
+
+// addPreviousHostPlayer creates a player for the host, named after their Spotify account. It is ready right
+// away, so handing off the game doesn't keep it from starting. It isn't added to the game yet, see playerJoined.
+func (g *GameService) addPreviousHostPlayer(repository *repositories.GameRepository, game *models.Game) (*models.Player, error) {
+	previousHost, err := g.userService.FindUser(game.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := availableNickname(game, previousHost.SpotifyProfile.DisplayName)
+	player := &models.Player{GameID: game.ID, UserID: &previousHost.ID, Name: name, Ready: true}
+	if err := repository.CreatePlayer(player); err != nil {
+		return nil, err
+	}
+
+	return player, nil
+}
+
+// StartRound picks a random track that has not been played in this game yet and starts a new round with it.
+// The previous round must have been revealed before a new one can be started. In timeline games every
+// player without a card is dealt a starting card first.
+func (g *GameService) StartRound(game *models.Game, tracks []models.Track) (*models.Round, error) {
+	if game.Status == models.GameStatusFinished {
+		return nil, ErrGameFinished
+	}
+
+	if len(game.Players) == 0 {
+		return nil, ErrNotEnoughPlayers
+	}
+
+	if game.Status == models.GameStatusCreated && !playersReady(game) {
+		return nil, ErrPlayersNotReady
+	}
+
+	current := game.CurrentRound()
+	if current != nil && current.Status != models.RoundStatusRevealed {
+		return nil, ErrRoundNotFinished
+	}
+
+	candidates := unplayedTracks(game, tracks)
+
+	if game.Mode == models.GameModeTimeline {
+		var err error
+		if candidates, err = g.dealStartingCards(game, candidates); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrNoTracksLeft
+	}
+
+	track := candidates[0]
+	round := &models.Round{
+		GameID:               game.ID,
+		Number:               len(game.Rounds) + 1,
+		Status:               models.RoundStatusPlaying,
+		TrackID:              track.ID,
+		TrackName:            track.Name,
+		ArtistName:           track.ArtistName,
+		AlbumName:            track.AlbumName,
+		ReleaseDate:          track.ReleaseDate,
+		ReleaseDatePrecision: track.ReleaseDatePrecision,
+		OriginalYear:         track.OriginalYear,
+		OriginalYearSource:   track.OriginalYearSource,
+	}
+
+	if err := g.repository.CreateRound(round); err != nil {
+		return nil, err
+	}
+
+	game.Rounds = append(game.Rounds, *round)
+
+	if game.Status == models.GameStatusCreated {
+		// nobody can join a running game, so the join code is made available to other games
+		game.Status = models.GameStatusRunning
+		game.JoinCode = ""
+		game.JoinCodeExpiresAt = nil
+		if err := g.repository.UpdateGame(game); err != nil {
+			return nil, err
+		}
+	}
+
+	g.hub.Publish(game.ID, events.RoundStarted, events.RoundData{Round: round.Redacted()})
+
+	return round, nil
+}
+
+// dealStartingCards gives every player with an empty timeline a first card and returns the tracks left over.
+func (g *GameService) dealStartingCards(game *models.Game, candidates []models.Track) ([]models.Track, error) {
+	var cards []models.TimelineCard
+	var owners []*models.Player
+
+	for i := range game.Players {
+		player := &game.Players[i]
+		if len(player.Cards) > 0 {
+			continue
+		}
+
+		for len(candidates) > 0 {
+			track := candidates[0]
+			candidates = candidates[1:]
+
+			if date, err := track.ScoringDate(); err == nil {
+				cards = append(cards, cardFromTrack(player.ID, track, date.Year))
+				owners = append(owners, player)
+				break
+			}
+		}
+	}
+
+	if len(owners) < countEmptyTimelines(game) {
+		return nil, ErrNoTracksLeft
+	}
+
+	if err := g.repository.CreateCards(cards); err != nil {
+		return nil, err
+	}
+
+	for i, player := range owners {
+		player.Cards = append(player.Cards, cards[i])
+		player.Score = len(player.Cards)
+	}
+
+	return candidates, nil
+}
+
+// SubmitGuess records the guess of a player for the current round. Classic games expect a year,
+// timeline games the position in the player's timeline the track should be inserted at. Players guess
+// for themselves, the host also guesses for the players added by name, who have no phone of their own.
+func (g *GameService) SubmitGuess(user *models.User, game *models.Game, playerID uint, year int, position *int) (*models.Guess, error) {
+	round := game.CurrentRound()
+	if round == nil || round.Status != models.RoundStatusPlaying {
+		return nil, ErrNoRoundPlaying
+	}
+
+	player := game.FindPlayer(playerID)
+	if player == nil {
+		return nil, ErrPlayerNotFound
+	}
+
+	ownPlayer := player.UserID != nil && *player.UserID == user.ID
+	addedByName := player.UserID == nil
+	if !ownPlayer && !(addedByName && game.IsHost(user.ID)) {
+		return nil, ErrForeignPlayer
+	}
+
+	if round.FindGuess(playerID) != nil {
+		return nil, ErrAlreadyGuessed
+	}
+
+	guess := &models.Guess{RoundID: round.ID, PlayerID: playerID}
+
+	if game.Mode == models.GameModeTimeline {
+		if position == nil || *position < 0 || *position > len(player.Cards) {
+			return nil, ErrInvalidPosition
+		}
+
+		guess.Position = position
+	} else {
+		guess.Year = year
+	}
+
+	// a concurrent guess of the same player slips past the check above, the database rejects it then
+	err := g.repository.CreateGuess(guess)
+	if errors.Is(err, repositories.ErrDuplicate) {
+		return nil, ErrAlreadyGuessed
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	round.Guesses = append(round.Guesses, *guess)
+	g.hub.Publish(game.ID, events.GuessSubmitted, events.GuessData{RoundID: round.ID, PlayerID: playerID})
+
+	return guess, nil
+}
+
+// RevealRound ends the current round, scores every guess and updates the players' scores.
+// The game is finished once the configured number of rounds has been played or, in timeline
+// games, as soon as a player has collected the target number of cards.
+func (g *GameService) RevealRound(game *models.Game) (*models.Round, error) {
+	round := game.CurrentRound()
+	if round == nil || round.Status != models.RoundStatusPlaying {
+		return nil, ErrNoRoundPlaying
+	}
+
+	var cards []models.TimelineCard
+
+	date, err := round.ScoringDate()
+	if err != nil {
+		// nobody can be scored fairly against a broken date, so the round simply doesn't count
+		slog.Warn("Round has a malformed release date", "round", round.ID, "error", err)
+		round.Unscored = true
+	} else if game.Mode == models.GameModeTimeline {
+		cards = scoreTimelineRound(game, round, date)
+	} else {
+		scoreClassicRound(game, round, date)
+	}
+
+	round.Status = models.RoundStatusRevealed
+
+	finished := game.MaxRounds > 0 && round.Number >= game.MaxRounds
+	if game.Mode == models.GameModeTimeline && hasReachedTarget(game) {
+		finished = true
+	}
+
+	err = g.transactor.Transaction(func(tx repositories.Tx) error {
+		repository := g.repository.WithTx(tx)
+		if err := repository.SaveScoring(round, game.Players, cards); err != nil {
+			return err
+		}
+
+		if finished {
+			return finishGame(repository, game)
+		}
+
+		return nil
+	})
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, ErrNoRoundPlaying
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	g.hub.Publish(game.ID, events.TrackRevealed, events.RoundData{Round: *round})
+	g.hub.Publish(game.ID, events.ScoresUpdated, events.NewScoresData(game))
+
+	return round, nil
+}
+
+func scoreClassicRound(game *models.Game, round *models.Round, date models.ReleaseDate) {
+	for i := range round.Guesses {
+		guess := &round.Guesses[i]
+		guess.Points = pointsForYearGuess(guess.Year, date)
+		guess.Correct = guess.Year == date.Year
+
+		if player := game.FindPlayer(guess.PlayerID); player != nil {
+			player.Score += guess.Points
+		}
+	}
+}
+
+// scoreTimelineRound awards the card to every player who placed it correctly; wrong placements
+// discard the card. It returns the cards that have been won.
+func scoreTimelineRound(game *models.Game, round *models.Round, date models.ReleaseDate) []models.TimelineCard {
+	var cards []models.TimelineCard
+
+	for i := range round.Guesses {
+		guess := &round.Guesses[i]
+		player := game.FindPlayer(guess.PlayerID)
+		if player == nil || guess.Position == nil {
+			continue
+		}
+
+		if !placementIsCorrect(player.Cards, *guess.Position, date.Year) {
+			continue
+		}
+
+		card := cardFromRound(player.ID, round, date.Year)
+		cards = append(cards, card)
+
+		guess.Correct = true
+		guess.Points = 1
+		player.Cards = insertCard(player.Cards, card)
+		player.Score = len(player.Cards)
+	}
+
+	return cards
+}
+
+// FinishGame ends the game and declares the player with the highest score the winner.
+// If several players share the highest score, the one who joined first wins.
+func (g *GameService) FinishGame(game *models.Game) error {
+	if game.Status == models.GameStatusFinished {
+		return ErrGameFinished
+	}
+
+	err := g.transactor.Transaction(func(tx repositories.Tx) error {
+		return finishGame(g.repository.WithTx(tx), game)
+	})
+	if err != nil {
+		return err
+	}
+
+	g.hub.Publish(game.ID, events.ScoresUpdated, events.NewScoresData(game))
+
+	return nil
+}
+
+// finishGame declares the winner and stores the game as finished.
+func finishGame(repository *repositories.GameRepository, game *models.Game) error {
+	game.Status = models.GameStatusFinished
+
+	var winner *models.Player
+	for i := range game.Players {
+		if winner == nil || game.Players[i].Score > winner.Score {
+			winner = &game.Players[i]
+		}
+	}
+
+	if winner != nil {
+		game.WinnerID = &winner.ID
+	}
+
+	if err := repository.UpdateGame(game); err != nil {
+		return err
+	}
+
+	// guests expire along with the game, once they have had a chance to look at the results
+	return repository.ExpireGuests(game.ID, time.Now().Add(guestGracePeriod))
+}
+
+// Subscribe returns a subscription to the events of the game. Clients reconnecting with the ID of the last
+// event they have received get the events they have missed, or a Reset event if they can't be resumed.
+func (g *GameService) Subscribe(game *models.Game, lastEventID uint64) (*events.Subscription, []events.Event) {
+	if lastEventID == 0 {
+		return g.hub.Subscribe(game.ID), nil
+	}
+
+	subscription, missed, ok := g.hub.Resume(game.ID, lastEventID)
+	if !ok {
+		return subscription, []events.Event{{GameID: game.ID, Type: events.Reset, Time: time.Now()}}
+	}
+
+	return subscription, missed
+}
+
+// unplayedTracks returns the tracks in random order that have neither been played in a round
+// nor dealt as a card in this game yet.
+func unplayedTracks(game *models.Game, tracks []models.Track) []models.Track {
+	played := make(map[string]bool, len(game.Rounds))
+	for _, round := range game.Rounds {
+		played[round.TrackID] = true
+	}
+
+	for _, player := range game.Players {
+		for _, card := range player.Cards {
+			played[card.TrackID] = true
+		}
+	}
+
+	var candidates []models.Track
+	for _, track := range tracks {
+		if track.ID == "" || played[track.ID] {
+			continue
+		}
+
+		// tracks without a usable release date can't be scored, so they are never picked
+		if _, err := track.ScoringDate(); err != nil {
+			slog.Warn("Skipping track with malformed release date", "track", track.ID, "error", err)
+			continue
+		}
+
+		candidates = append(candidates, track)
+		played[track.ID] = true
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	// tracks whose year is probably wrong are only played once the reliable ones have run out
+	slices.SortStableFunc(candidates, func(a, b models.Track) int {
+		switch {
+		case a.ReleaseYearSuspect == b.ReleaseYearSuspect:
+			return 0
+		case b.ReleaseYearSuspect:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	return candidates
+}
+
+// checkNickname returns the trimmed nickname if it is valid and not taken by another player of the game yet.
+func checkNickname(game *models.Game, nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" || utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return "", ErrInvalidNickname
+	}
+
+	for _, player := range game.Players {
+		if strings.EqualFold(player.Name, nickname) {
+			return "", ErrNicknameTaken
+		}
+	}
+
+	return nickname, nil
+}
+
+// availableNickname returns a nickname based on name that no player of the game has taken yet. Without
+// a name, it is based on "Host".
+func availableNickname(game *models.Game, name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Host"
+	}
+
+	for i := 1; ; i++ {
+		suffix := ""
+		if i > 1 {
+			suffix = fmt.Sprintf(" %d", i)
+		}
+
+		base := []rune(name)
+		if len(base) > maxNicknameLength-len(suffix) {
+			base = base[:maxNicknameLength-len(suffix)]
+		}
+
+		if nickname, err := checkNickname(game, string(base)+suffix); err == nil {
+			return nickname
+		}
+	}
+}
+
+// playersReady reports whether every player who has joined from the lobby is ready. Players added by the
+// host and the host's own player don't have to be.
+func playersReady(game *models.Game) bool {
+	for _, player := range game.Players {
+		if player.UserID != nil && !game.IsHost(*player.UserID) && !player.Ready {
+			return false
+		}
+	}
+
+	return true
+}
+
+func countEmptyTimelines(game *models.Game) int {
+	count := 0
+	for _, player := range game.Players {
+		if len(player.Cards) == 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// pointsForYearGuess awards 10 points for the exact year and fewer the further off the guess is.
+func pointsForYearGuess(guess int, date models.ReleaseDate) int {
+	diff := date.YearsFrom(guess)
+
+	switch {
+	case diff == 0:
+		return 10
+	case diff <= 2:
+		return 5
+	case diff <= 5:
+		return 2
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/repositories"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// LoginTicketPrefix identifies login tickets, they can't be mistaken for API tokens.
+	LoginTicketPrefix = "mbg_ticket_"
+
+	loginTicketLength = 32
+	loginTicketTTL    = 10 * time.Minute
+
+	// the user has this long to log in at Spotify
+	oauthStateLength = 32
+	oauthStateTTL    = 15 * time.Minute
+)
+
+var (
+	ErrInvalidLoginTicket = errors.New("login ticket is invalid, expired or has already been used")
+	ErrInvalidOAuthState  = errors.New("authorization is invalid or has expired, please try again")
+	ErrInvalidRedirectURI = errors.New("redirect URI is not allowed")
+)
+
+// LoginTicketService runs the Spotify authorization of a user: the app gets a login ticket to open
+// /spotify/auth with in the browser in place of the API token. The ticket is traded for an OAuth state,
+// which is kept on the server until Spotify redirects back with it.
+type LoginTicketService struct {
+	repository           *repositories.LoginTicketRepository
+	oauthStateRepository *repositories.OAuthStateRepository
+	userRepository       *repositories.UserRepository
+	hasher               *crypto.TokenHasher
+	// redirectURIs the app may return to after linking, see redirectURIAllowed
+	redirectURIs []string
+}
+
+func NewLoginTicketService(
+	repository *repositories.LoginTicketRepository,
+	oauthStateRepository *repositories.OAuthStateRepository,
+	userRepository *repositories.UserRepository,
+	hasher *crypto.TokenHasher,
+	redirectURIs []string,
+) *LoginTicketService {
+	return &LoginTicketService{repository, oauthStateRepository, userRepository, hasher, redirectURIs}
+}
+
+// CreateTicket returns a new login ticket for the user along with its plaintext. After linking Spotify,
+// the user is sent back to redirectURI if it is given, which has to be on the allow-list.
+func (l *LoginTicketService) CreateTicket(user *models.User, redirectURI string) (*models.LoginTicket, string, error) {
+	if redirectURI != "" && !l.redirectURIAllowed(redirectURI) {
+		return nil, "", ErrInvalidRedirectURI
+	}
+
+	plaintext, err := crypto.PrefixedToken(LoginTicketPrefix, loginTicketLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ticket := &models.LoginTicket{
+		UserID:      user.ID,
+		Hash:        l.hasher.Hash(plaintext),
+		ExpiresAt:   time.Now().Add(loginTicketTTL),
+		RedirectURI: redirectURI,
+	}
+
+	if err := l.repository.CreateLoginTicket(ticket); err != nil {
+		return nil, "", err
+	}
+
+	return ticket, plaintext, nil
+}
+
+// StartAuthorization uses up the login ticket and starts an authorization for its user. It returns
+// the OAuth state to send to Spotify along with the PKCE verifier the code is bound to.
+func (l *LoginTicketService) StartAuthorization(ticketPlaintext string) (string, string, error) {
+	ticket, err := l.repository.UseLoginTicket(l.hasher.Hash(ticketPlaintext))
+	if errors.Is(err, repositories.ErrNotFound) {
+		return "", "", ErrInvalidLoginTicket
+	}
+
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := crypto.URLSafeToken(oauthStateLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	oauthState := &models.OAuthState{
+		UserID:       ticket.UserID,
+		Hash:         l.hasher.Hash(state),
+		RedirectURI:  ticket.RedirectURI,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		ExpiresAt:    time.Now().Add(oauthStateTTL),
+	}
+
+	if err := l.oauthStateRepository.CreateOAuthState(oauthState); err != nil {
+		return "", "", err
+	}
+
+	return state, oauthState.CodeVerifier, nil
+}
+
+// CompleteAuthorization uses up the OAuth state Spotify redirected back with and returns it along with
+// the user that started the authorization.
+func (l *LoginTicketService) CompleteAuthorization(state string) (*models.OAuthState, *models.User, error) {
+	oauthState, err := l.oauthStateRepository.UseOAuthState(l.hasher.Hash(state))
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, nil, ErrInvalidOAuthState
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := l.userRepository.FindUserByID(oauthState.UserID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, nil, ErrInvalidOAuthState
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return oauthState, user, nil
+}
+
+// DeleteExpired removes login tickets and OAuth states that can't be used anymore.
+func (l *LoginTicketService) DeleteExpired() error {
+	if err := l.repository.DeleteExpiredLoginTickets(time.Now()); err != nil {
+		return err
+	}
+
+	return l.oauthStateRepository.DeleteExpiredOAuthStates(time.Now())
+}
+
+// redirectURIAllowed reports whether the URI is on the allow-list. Entries either match the URI exactly
+// or, if they consist of a scheme only like "musicbox://", any URI of that scheme.
+func (l *LoginTicketService) redirectURIAllowed(redirectURI string) bool {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil || parsed.Scheme == "" || parsed.Fragment != "" {
+		return false
+	}
+
+	for _, allowed := range l.redirectURIs {
+		if redirectURI == allowed {
+			return true
+		}
+
+		scheme, rest, ok := strings.Cut(allowed, "://")
+		if ok && rest == "" && scheme == parsed.Scheme && scheme != "http" && scheme != "https" {
+			return true
+		}
+	}
+
+	return false
+}
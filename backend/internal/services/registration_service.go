@@ -0,0 +1,250 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/repositories"
+)
+
+var (
+	ErrRegistrationForbidden   = errors.New("registration requires a valid app secret")
+	ErrInvalidInvite           = errors.New("invite is invalid, expired or has already been used")
+	ErrInvalidRegistrationMode = errors.New("invalid registration mode")
+	ErrNotGuest                = errors.New("user is not a guest")
+)
+
+// RegistrationMode defines what is needed to create a new user. It is stored with the user as the
+// source it has been created by.
+type RegistrationMode string
+
+const (
+	// RegistrationOpen lets anyone register, only limited by the rate limits on POST /auth.
+	RegistrationOpen RegistrationMode = "open"
+	// RegistrationAppSecret requires the secret shipped with the app.
+	RegistrationAppSecret RegistrationMode = "app_secret"
+	// RegistrationInvite requires a signed invite code, each of which can be used once.
+	RegistrationInvite RegistrationMode = "invite"
+)
+
+func ParseRegistrationMode(value string) (RegistrationMode, error) {
+	switch mode := RegistrationMode(value); mode {
+	case RegistrationOpen, RegistrationAppSecret, RegistrationInvite:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrInvalidRegistrationMode, value)
+}
+
+type RegistrationConfig struct {
+	Mode RegistrationMode
+	// AppSecret is required in RegistrationAppSecret mode.
+	AppSecret string
+	// InviteSigner signs invite codes, it is required to create and use invites.
+	InviteSigner *crypto.Signer
+}
+
+type RegistrationService struct {
+	config           RegistrationConfig
+	userService      *UserService
+	apiTokenService  *APITokenService
+	gameService      *GameService
+	inviteRepository *repositories.InviteRepository
+	transactor       *repositories.Transactor
+}
+
+func NewRegistrationService(
+	config RegistrationConfig,
+	userService *UserService,
+	apiTokenService *APITokenService,
+	gameService *GameService,
+	inviteRepository *repositories.InviteRepository,
+	transactor *repositories.Transactor,
+) (*RegistrationService, error) {
+	switch {
+	case config.Mode == RegistrationAppSecret && config.AppSecret == "":
+		return nil, errors.New("an app secret is required to register with it")
+	case config.Mode == RegistrationInvite && config.InviteSigner == nil:
+		return nil, errors.New("an invite signing key is required to register with invites")
+	}
+
+	return &RegistrationService{config, userService, apiTokenService, gameService, inviteRepository, transactor}, nil
+}
+
+// Register creates a new user if the app secret or the invite code satisfy the registration mode.
+// It returns the user along with the plaintext of its first API token, which is named after tokenName.
+// The invite is only used up if the user has been created along with its token.
+func (r *RegistrationService) Register(appSecret, inviteCode, tokenName string) (*models.User, string, error) {
+	var user *models.User
+	var apiToken string
+
+	err := r.transactor.Transaction(func(tx repositories.Tx) error {
+		inviteID, err := r.authorize(tx, appSecret, inviteCode)
+		if err != nil {
+			return err
+		}
+
+		user, err = r.userService.WithTx(tx).CreateUser(string(r.config.Mode))
+		if err != nil {
+			return err
+		}
+
+		if err := r.finish(tx, user, inviteID); err != nil {
+			return err
+		}
+
+		_, apiToken, err = r.apiTokenService.WithTx(tx).CreateToken(user, tokenName, nil)
+
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, apiToken, nil
+}
+
+// RegisterGuest creates a guest who joins the game with the join code under the given nickname. Guests
+// don't need to satisfy the registration mode, the join code is enough. Their API token expires after
+// GuestTTL or soon after the game has finished, whatever comes first.
+func (r *RegistrationService) RegisterGuest(joinCode, nickname, tokenName string) (*models.User, *models.Game, *models.Player, string, error) {
+	expiresAt := time.Now().Add(GuestTTL)
+	var apiToken string
+
+	guest, game, player, err := r.gameService.JoinAsGuest(joinCode, nickname, func(tx repositories.Tx, guest *models.User) error {
+		var err error
+		_, apiToken, err = r.apiTokenService.WithTx(tx).CreateToken(guest, tokenName, &expiresAt)
+
+		return err
+	})
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	return guest, game, player, apiToken, nil
+}
+
+// UpgradeGuest turns the guest into a full user if the app secret or the invite code satisfy the registration
+// mode. The user keeps its ID along with the games it has played and gets a new API token that doesn't expire,
+// the guest's token is revoked along the way.
+func (r *RegistrationService) UpgradeGuest(user *models.User, guestToken *models.APIToken, appSecret, inviteCode, tokenName string) (string, error) {
+	if !user.IsGuest() {
+		return "", ErrNotGuest
+	}
+
+	var apiToken string
+
+	err := r.transactor.Transaction(func(tx repositories.Tx) error {
+		inviteID, err := r.authorize(tx, appSecret, inviteCode)
+		if err != nil {
+			return err
+		}
+
+		if err := r.userService.WithTx(tx).UpgradeGuest(user, string(r.config.Mode)); err != nil {
+			return err
+		}
+
+		if err := r.finish(tx, user, inviteID); err != nil {
+			return err
+		}
+
+		apiTokenService := r.apiTokenService.WithTx(tx)
+		if _, apiToken, err = apiTokenService.CreateToken(user, tokenName, nil); err != nil {
+			return err
+		}
+
+		return apiTokenService.RevokeToken(user, guestToken.ID)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return apiToken, nil
+}
+
+// authorize checks the app secret or the invite code, depending on the registration mode. Invites are used
+// up within the transaction, their ID is returned so the user can be recorded on it.
+func (r *RegistrationService) authorize(tx repositories.Tx, appSecret, inviteCode string) (string, error) {
+	switch r.config.Mode {
+	case RegistrationAppSecret:
+		if !crypto.Equal(appSecret, r.config.AppSecret) {
+			return "", ErrRegistrationForbidden
+		}
+	case RegistrationInvite:
+		return r.useInvite(tx, inviteCode)
+	}
+
+	return "", nil
+}
+
+// finish records the user on the invite it has registered with, if any.
+func (r *RegistrationService) finish(tx repositories.Tx, user *models.User, inviteID string) error {
+	if inviteID == "" {
+		return nil
+	}
+
+	return r.inviteRepository.WithTx(tx).SetInviteUser(inviteID, user.ID)
+}
+
+func (r *RegistrationService) useInvite(tx repositories.Tx, inviteCode string) (string, error) {
+	id, err := r.verifyInvite(inviteCode)
+	if err != nil {
+		return "", err
+	}
+
+	if err := r.inviteRepository.WithTx(tx).UseInvite(id); err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return "", ErrInvalidInvite
+		}
+
+		return "", err
+	}
+
+	return id, nil
+}
+
+// CreateInvite returns a new invite code that is valid for the given duration. Codes have the format
+// "id.expiry.signature", so forged or expired codes are rejected without a database lookup.
+func (r *RegistrationService) CreateInvite(validFor time.Duration) (string, error) {
+	if r.config.InviteSigner == nil {
+		return "", errors.New("an invite signing key is required to create invites")
+	}
+
+	id, err := crypto.URLSafeToken(12)
+	if err != nil {
+		return "", err
+	}
+
+	invite := &models.Invite{ID: id, ExpiresAt: time.Now().Add(validFor)}
+	if err := r.inviteRepository.CreateInvite(invite); err != nil {
+		return "", err
+	}
+
+	payload := id + "." + strconv.FormatInt(invite.ExpiresAt.Unix(), 10)
+
+	return payload + "." + r.config.InviteSigner.Sign(payload), nil
+}
+
+// verifyInvite checks signature and expiry of the invite code and returns the ID of the invite.
+func (r *RegistrationService) verifyInvite(inviteCode string) (string, error) {
+	parts := strings.Split(inviteCode, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidInvite
+	}
+
+	if !r.config.InviteSigner.Verify(parts[0]+"."+parts[1], parts[2]) {
+		return "", ErrInvalidInvite
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return "", ErrInvalidInvite
+	}
+
+	return parts[0], nil
+}
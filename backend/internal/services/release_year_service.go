@@ -0,0 +1,139 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+)
+
+// earliestPlausibleYear guards against obviously broken entries in the reference dataset.
+const earliestPlausibleYear = 1877
+
+// reissueSignals are markers of remasters, reissues and compilations in album names. Generic words like
+// "gold" or "hits" are left out, as plenty of original albums use them too.
+var reissueSignals = regexp.MustCompile(`(?i)\b(remaster(ed)?|re-?issued?|(anniversary|deluxe|expanded|legacy) (edition|version)|greatest hits|compilation)\b`)
+
+// ReleaseYearService works out the year a track was first released, as Spotify dates many tracks
+// to the remaster or compilation they are taken from.
+type ReleaseYearService struct {
+	firstReleaseByISRC map[string]int
+}
+
+func NewReleaseYearService() *ReleaseYearService {
+	return &ReleaseYearService{firstReleaseByISRC: map[string]int{}}
+}
+
+// LoadReferenceFile loads a CSV file of ISRC and first release year pairs, see LoadReference.
+func (r *ReleaseYearService) LoadReferenceFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return r.LoadReference(f)
+}
+
+// LoadReference loads an offline reference dataset (e.g. derived from MusicBrainz) with the columns
+// isrc and year. A header row is optional. If an ISRC appears more than once, the earliest year wins.
+func (r *ReleaseYearService) LoadReference(reader io.Reader) error {
+	records := csv.NewReader(reader)
+	records.FieldsPerRecord = 2
+	records.ReuseRecord = true
+
+	for line := 1; ; line++ {
+		record, err := records.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		year, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			if line == 1 {
+				// header
+				continue
+			}
+
+			return fmt.Errorf("invalid year in line %d: %w", line, err)
+		}
+
+		isrc := normalizeISRC(record[0])
+		if isrc == "" || year < earliestPlausibleYear {
+			continue
+		}
+
+		if known, ok := r.firstReleaseByISRC[isrc]; !ok || year < known {
+			r.firstReleaseByISRC[isrc] = year
+		}
+	}
+}
+
+// Enrich sets the original release year of every track whose Spotify date is later than the earliest
+// plausible one. Candidates are the reference dataset and other releases of the same recording (same
+// ISRC) in the given tracks. Tracks from remasters or compilations without a correction are flagged.
+func (r *ReleaseYearService) Enrich(tracks []models.Track) {
+	earliestInPlaylist := map[string]int{}
+	for _, track := range tracks {
+		date, err := track.Release()
+		isrc := normalizeISRC(track.ISRC)
+		if err != nil || isrc == "" {
+			continue
+		}
+
+		if known, ok := earliestInPlaylist[isrc]; !ok || date.Year < known {
+			earliestInPlaylist[isrc] = date.Year
+		}
+	}
+
+	for i := range tracks {
+		track := &tracks[i]
+		track.OriginalYear = 0
+		track.OriginalYearSource = ""
+
+		date, err := track.Release()
+		if err != nil {
+			date.Year = 0
+		}
+
+		isrc := normalizeISRC(track.ISRC)
+
+		if year, ok := earliestInPlaylist[isrc]; ok && year < date.Year {
+			track.OriginalYear = year
+			track.OriginalYearSource = models.OriginalYearSourcePlaylist
+		}
+
+		if year, ok := r.firstReleaseByISRC[isrc]; ok && (date.Year == 0 || year < date.Year) &&
+			(track.OriginalYear == 0 || year < track.OriginalYear) {
+			track.OriginalYear = year
+			track.OriginalYearSource = models.OriginalYearSourceReference
+		}
+
+		track.ReleaseYearSuspect = track.OriginalYear == 0 && isReissue(track)
+	}
+}
+
+// isReissue looks for signs that the album of the track is not its original release. Track names are
+// not looked at, they say nothing about the album.
+func isReissue(track *models.Track) bool {
+	if track.AlbumType == "compilation" {
+		return true
+	}
+
+	return reissueSignals.MatchString(track.AlbumName)
+}
+
+func normalizeISRC(isrc string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(isrc), "-", ""))
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"slices"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+)
+
+const defaultTargetCards = 10
+
+// placementIsCorrect checks whether a card with the given year may be inserted at position into a
+// chronologically sorted timeline, i.e. between cards[position-1] and cards[position].
+//
+// Cards with the same year are interchangeable: a card placed directly before or after a card of
+// the same year is always correct, no matter in which order they were released during that year.
+func placementIsCorrect(cards []models.TimelineCard, position int, year int) bool {
+	if position < 0 || position > len(cards) {
+		return false
+	}
+
+	if position > 0 && cards[position-1].ReleaseYear > year {
+		return false
+	}
+
+	if position < len(cards) && cards[position].ReleaseYear < year {
+		return false
+	}
+
+	return true
+}
+
+// insertCard adds the card to the timeline while keeping it sorted by year. A card is placed after
+// all other cards of the same year, matching the order the cards are loaded from the database.
+func insertCard(cards []models.TimelineCard, card models.TimelineCard) []models.TimelineCard {
+	i := len(cards)
+	for i > 0 && cards[i-1].ReleaseYear > card.ReleaseYear {
+		i--
+	}
+
+	return slices.Insert(cards, i, card)
+}
+
+func cardFromTrack(playerID uint, track models.Track, year int) models.TimelineCard {
+	return models.TimelineCard{
+		PlayerID:    playerID,
+		TrackID:     track.ID,
+		TrackName:   track.Name,
+		ArtistName:  track.ArtistName,
+		ReleaseYear: year,
+	}
+}
+
+func cardFromRound(playerID uint, round *models.Round, year int) models.TimelineCard {
+	return models.TimelineCard{
+		PlayerID:    playerID,
+		TrackID:     round.TrackID,
+		TrackName:   round.TrackName,
+		ArtistName:  round.ArtistName,
+		ReleaseYear: year,
+	}
+}
+
+// hasReachedTarget reports whether any player has collected enough cards to win the timeline game.
+func hasReachedTarget(game *models.Game) bool {
+	for _, player := range game.Players {
+		if len(player.Cards) >= game.TargetCards {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,22 +1,233 @@
 package services
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/domnikl/music-box-game/backend/internal/models"
 	"github.com/domnikl/music-box-game/backend/internal/repositories"
 )
 
+const (
+	// GuestSource is the source of users who have joined a game as a guest.
+	GuestSource = "guest"
+
+	// the owner of a Spotify account has this long to accept merging another user that has linked it
+	mergeRequestTTL = 24 * time.Hour
+)
+
+var (
+	ErrSpotifyAccountLinked = errors.New("Spotify account is linked to another user, accept merging on a device logged in as that user")
+	ErrMergeRequestNotFound = errors.New("merge request not found")
+)
+
 type UserService struct {
-	repository *repositories.UserRepository
+	repository    *repositories.UserRepository
+	mergeRequests *repositories.MergeRequestRepository
+}
+
+func NewUserService(repository *repositories.UserRepository, mergeRequests *repositories.MergeRequestRepository) *UserService {
+	return &UserService{repository, mergeRequests}
 }
 
-func NewUserService(repository *repositories.UserRepository) *UserService {
-	return &UserService{repository}
+// WithTx returns a copy of the service that works within the transaction.
+func (u *UserService) WithTx(tx repositories.Tx) *UserService {
+	return &UserService{u.repository.WithTx(tx), u.mergeRequests.WithTx(tx)}
 }
 
-func (u *UserService) CreateUser(user *models.User) error {
-	return u.repository.CreateUser(user)
+// CreateUser creates a user without any API tokens. source tells how the user has registered.
+func (u *UserService) CreateUser(source string) (*models.User, error) {
+	user := &models.User{CreatedVia: source}
+	if err := u.repository.CreateUser(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// CreateGuest creates a guest who can only take part in the given game.
+func (u *UserService) CreateGuest(gameID uint) (*models.User, error) {
+	user := &models.User{CreatedVia: GuestSource, GuestGameID: &gameID}
+	if err := u.repository.CreateUser(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// UpgradeGuest turns the guest into a full user, source tells how it has registered. The user keeps its ID,
+// so the games it has played stay its own.
+func (u *UserService) UpgradeGuest(user *models.User, source string) error {
+	if err := u.repository.UpgradeGuest(user, source); err != nil {
+		return err
+	}
+
+	user.GuestGameID = nil
+	user.CreatedVia = source
+
+	return nil
+}
+
+// DeleteExpiredGuests deletes guests who can't take part in their game anymore, because their tokens have
+// expired, the game has finished a while ago or has been abandoned.
+func (u *UserService) DeleteExpiredGuests() error {
+	now := time.Now()
+
+	return u.repository.DeleteGuests(now, now.Add(-guestGracePeriod), now.Add(-guestIdleTimeout))
 }
 
 func (u *UserService) UpdateUser(user *models.User) error {
 	return u.repository.UpdateUser(user)
 }
+
+func (u *UserService) FindUser(id uint) (*models.User, error) {
+	return u.repository.FindUserByID(id)
+}
+
+// LinkSpotify stores new Spotify tokens for the user and clears a previously broken link.
+func (u *UserService) LinkSpotify(user *models.User, accessToken, refreshToken string, expiresAt time.Time) error {
+	user.SpotifyToken = accessToken
+	user.SpotifyRefreshToken = refreshToken
+	user.SpotifyTokenExpiresAt = &expiresAt
+	user.SpotifyLinkBrokenAt = nil
+
+	return u.repository.UpdateSpotifyTokens(user)
+}
+
+// LinkSpotifyAccount stores the tokens and profile of the Spotify account the user has just authorized.
+// If another user has linked the same account before, e.g. before the app has been reinstalled, nothing
+// is stored: a merge request is raised instead, which that user has to accept, and
+// ErrSpotifyAccountLinked is returned. Otherwise anybody could take over the account's user by having
+// its owner finish an authorization they have started.
+func (u *UserService) LinkSpotifyAccount(user *models.User, accessToken, refreshToken string, expiresAt time.Time, profile models.SpotifyProfile) error {
+	existing, err := u.repository.FindUserBySpotifyUserID(profile.UserID)
+	if err == nil && existing.ID != user.ID {
+		return u.requestMerge(user, existing)
+	}
+
+	if err != nil && !errors.Is(err, repositories.ErrNotFound) {
+		return err
+	}
+
+	if err := u.LinkSpotify(user, accessToken, refreshToken, expiresAt); err != nil {
+		return err
+	}
+
+	return u.UpdateSpotifyProfile(user, profile)
+}
+
+func (u *UserService) requestMerge(from, into *models.User) error {
+	err := u.mergeRequests.SaveMergeRequest(&models.MergeRequest{
+		FromUserID: from.ID,
+		IntoUserID: into.ID,
+		ExpiresAt:  time.Now().Add(mergeRequestTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to request merging user %d into %d: %w", from.ID, into.ID, err)
+	}
+
+	return ErrSpotifyAccountLinked
+}
+
+// MergeRequests returns the pending requests to merge other users into the user.
+func (u *UserService) MergeRequests(user *models.User) ([]models.MergeRequest, error) {
+	return u.mergeRequests.FindMergeRequests(user.ID)
+}
+
+// AcceptMergeRequest merges the user that has raised the request into the user, which takes over its
+// API tokens and games.
+func (u *UserService) AcceptMergeRequest(user *models.User, id uint) error {
+	request, err := u.mergeRequests.UseMergeRequest(id, user.ID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return ErrMergeRequestNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	from, err := u.repository.FindUserByID(request.FromUserID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return ErrMergeRequestNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := u.repository.MergeUser(from, user); err != nil {
+		return fmt.Errorf("failed to merge user %d into %d: %w", from.ID, user.ID, err)
+	}
+
+	return nil
+}
+
+// DeclineMergeRequest removes the request without merging.
+func (u *UserService) DeclineMergeRequest(user *models.User, id uint) error {
+	err := u.mergeRequests.DeleteMergeRequest(id, user.ID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return ErrMergeRequestNotFound
+	}
+
+	return err
+}
+
+// DeleteExpiredMergeRequests removes merge requests that haven't been accepted in time.
+func (u *UserService) DeleteExpiredMergeRequests() error {
+	return u.mergeRequests.DeleteExpiredMergeRequests(time.Now())
+}
+
+// UpdateSpotifyProfile stores a fresh copy of the profile of the Spotify account the user has linked,
+// e.g. after the account has been upgraded to Premium.
+func (u *UserService) UpdateSpotifyProfile(user *models.User, profile models.SpotifyProfile) error {
+	user.SpotifyProfile = profile
+
+	return u.repository.UpdateSpotifyProfile(user)
+}
+
+// SetSpotifyProduct stores the subscription of the linked account, e.g. once Spotify has rejected a
+// player command because the account lacks Premium.
+func (u *UserService) SetSpotifyProduct(user *models.User, product string) error {
+	user.SpotifyProfile.Product = product
+
+	return u.repository.UpdateSpotifyProfile(user)
+}
+
+// UnlinkSpotify removes the Spotify tokens and profile of the user. The grant itself can only be
+// revoked by the user on Spotify's account page.
+func (u *UserService) UnlinkSpotify(user *models.User) error {
+	user.SpotifyToken = ""
+	user.SpotifyRefreshToken = ""
+	user.SpotifyTokenExpiresAt = nil
+	user.SpotifyLinkBrokenAt = nil
+	user.SpotifyProfile = models.SpotifyProfile{}
+
+	if err := u.repository.UpdateSpotifyTokens(user); err != nil {
+		return err
+	}
+
+	return u.repository.UpdateSpotifyProfile(user)
+}
+
+// MarkSpotifyLinkBroken remembers that the Spotify tokens of the user are no longer valid since the given time.
+func (u *UserService) MarkSpotifyLinkBroken(user *models.User, at time.Time) error {
+	user.SpotifyLinkBrokenAt = &at
+
+	return u.repository.UpdateSpotifyTokens(user)
+}
+
+// RememberDevice stores the device playback has last been started on, so it can be picked again
+// if the client doesn't ask for a specific device.
+func (u *UserService) RememberDevice(user *models.User, deviceID string) error {
+	user.LastDeviceID = deviceID
+
+	return u.repository.UpdateUser(&models.User{ID: user.ID, LastDeviceID: deviceID})
+}
+
+// SetPreferredDevice stores the device to fall back to if no device is active. An empty ID removes it.
+func (u *UserService) SetPreferredDevice(user *models.User, deviceID string) error {
+	user.PreferredDeviceID = deviceID
+
+	return u.repository.UpdatePreferredDevice(user)
+}
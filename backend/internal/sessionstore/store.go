@@ -0,0 +1,149 @@
+// Package sessionstore keeps sessions in Postgres, only their ID is stored in the cookie.
+package sessionstore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/crypto"
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/repositories"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultMaxAge = 86400 * 7
+
+	sessionIDLength = 32
+)
+
+// Store implements sessions.Store. Session IDs in cookies are signed and the values in the database
+// are encoded with the same codecs, so neither can be tampered with.
+type Store struct {
+	Codecs     []securecookie.Codec
+	Options    *sessions.Options
+	repository *repositories.SessionRepository
+}
+
+// New returns a store with key pairs of an authentication and an optional encryption key,
+// see securecookie.CodecsFromPairs.
+func New(repository *repositories.SessionRepository, keyPairs ...[]byte) *Store {
+	store := &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   defaultMaxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		repository: repository,
+	}
+
+	store.MaxAge(defaultMaxAge)
+
+	return store
+}
+
+// MaxAge sets the lifetime of new sessions and of the signatures of their IDs.
+func (s *Store) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	for _, codec := range s.Codecs {
+		if cookie, ok := codec.(*securecookie.SecureCookie); ok {
+			cookie.MaxAge(age)
+		}
+	}
+}
+
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session of the request or a new one if there is none or it has expired.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	stored, err := s.repository.FindSession(session.ID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		session.ID = ""
+		return session, nil
+	}
+
+	if err != nil {
+		return session, err
+	}
+
+	if err := securecookie.DecodeMulti(name, stored.Data, &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	session.IsNew = false
+
+	return session, nil
+}
+
+// Save stores the session and sets the cookie with its ID. Sessions with a negative MaxAge are deleted.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.repository.DeleteSession(session.ID); err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := crypto.URLSafeToken(sessionIDLength)
+		if err != nil {
+			return fmt.Errorf("failed to generate session ID: %w", err)
+		}
+
+		session.ID = id
+	}
+
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	err = s.repository.SaveSession(&models.Session{
+		ID:        session.ID,
+		Data:      data,
+		ExpiresAt: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+// DeleteExpired removes expired sessions from the database.
+func (s *Store) DeleteExpired() error {
+	return s.repository.DeleteExpiredSessions(time.Now())
+}
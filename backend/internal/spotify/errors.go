@@ -0,0 +1,67 @@
+package spotify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned if the requested playlist, track or other resource doesn't exist.
+	ErrNotFound = errors.New("spotify resource not found")
+	// ErrNoActiveDevice is returned by player commands if no device is available for playback.
+	ErrNoActiveDevice = errors.New("no active spotify device")
+	// ErrPremiumRequired is returned by player commands for users of Spotify Free.
+	ErrPremiumRequired = errors.New("spotify premium required")
+	// ErrTokenRevoked is returned when Spotify rejects the refresh token of a user for good,
+	// e.g. because they removed the app from their account. The user has to link Spotify again.
+	ErrTokenRevoked = errors.New("spotify refresh token has been revoked")
+	// ErrUpstreamUnavailable is returned if Spotify can't be reached or answers with a server error.
+	ErrUpstreamUnavailable = errors.New("spotify is unavailable")
+)
+
+// RateLimitedError is returned when Spotify keeps answering with 429 Too Many Requests or when the
+// request budget of a user is used up. RetryAfter tells the client when it makes sense to try again.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by Spotify, retry after %s", e.RetryAfter)
+}
+
+// checkResponse turns an unsuccessful response into one of the errors above. The body is consumed
+// in that case, but never closed.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var apiError struct {
+		Error struct {
+			Message string `json:"message"`
+			Reason  string `json:"reason"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &apiError)
+
+	switch {
+	case apiError.Error.Reason == "NO_ACTIVE_DEVICE":
+		return ErrNoActiveDevice
+	case apiError.Error.Reason == "PREMIUM_REQUIRED":
+		return ErrPremiumRequired
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitedError{RetryAfter: retryAfter(resp.Header)}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: %s", ErrUpstreamUnavailable, resp.Status)
+	}
+
+	return fmt.Errorf("unexpected response from spotify: %s %s", resp.Status, string(body))
+}
@@ -0,0 +1,56 @@
+package spotify
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+type Option func(*Spotify)
+
+// WithMaxPlaylistTracks limits how many tracks GetPlaylist fetches by following the pages of a playlist.
+func WithMaxPlaylistTracks(max int) Option {
+	return func(s *Spotify) {
+		s.maxPlaylistTracks = max
+	}
+}
+
+// WithAPIBaseURL sets the URL of the Web API, e.g. to point the client to a fake server.
+func WithAPIBaseURL(baseURL string) Option {
+	return func(s *Spotify) {
+		s.apiBaseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithTokenEndpoint sets the OAuth authorization and token URLs of the accounts service.
+func WithTokenEndpoint(authURL, tokenURL string) Option {
+	return func(s *Spotify) {
+		s.oauthConfig.Endpoint = oauth2.Endpoint{
+			AuthURL:   authURL,
+			TokenURL:  tokenURL,
+			AuthStyle: oauth2.AuthStyleInHeader,
+		}
+	}
+}
+
+// WithHTTPClient sets the client used for requests to the Web API as well as to the token endpoint.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Spotify) {
+		s.httpClient = client
+	}
+}
+
+// WithClock replaces the system clock, e.g. to test token expiry and backoff without waiting.
+func WithClock(clock Clock) Option {
+	return func(s *Spotify) {
+		s.clock = clock
+	}
+}
+
+// WithRequestBudget sets how many requests per second may be sent on behalf of a single user.
+func WithRequestBudget(requestsPerSecond float64, burst int) Option {
+	return func(s *Spotify) {
+		s.budget = newRequestBudget(requestsPerSecond, burst)
+	}
+}
@@ -0,0 +1,45 @@
+package spotify
+
+import (
+	"sync"
+	"time"
+)
+
+// premiumRecheckInterval is how long an account is trusted to lack Premium once that has been
+// checked. Player commands are refused without asking Spotify until then.
+const premiumRecheckInterval = 10 * time.Minute
+
+// premiumChecks remembers when accounts lacking Premium have last been checked.
+type premiumChecks struct {
+	mu        sync.Mutex
+	checkedAt map[uint]time.Time
+}
+
+func newPremiumChecks() *premiumChecks {
+	return &premiumChecks{checkedAt: map[uint]time.Time{}}
+}
+
+// due tells whether the account of the user has to be checked again.
+func (p *premiumChecks) due(userID uint, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	checkedAt, ok := p.checkedAt[userID]
+
+	return !ok || now.Sub(checkedAt) >= premiumRecheckInterval
+}
+
+// checked records that the account of the user has been found to lack Premium. Checks that are due
+// anyway are dropped along the way.
+func (p *premiumChecks) checked(userID uint, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, checkedAt := range p.checkedAt {
+		if now.Sub(checkedAt) >= premiumRecheckInterval {
+			delete(p.checkedAt, id)
+		}
+	}
+
+	p.checkedAt[userID] = now
+}
@@ -0,0 +1,159 @@
+package spotify
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxRetries       = 3
+	maxRetryWait     = 5 * time.Second
+	retryBaseBackoff = 250 * time.Millisecond
+
+	defaultRequestsPerSecond = 5
+	defaultRequestBurst      = 10
+
+	// budgetPruneInterval is how often budgets of users without recent requests are dropped.
+	budgetPruneInterval = 10 * time.Minute
+)
+
+// Clock abstracts time, so backoff and token expiry can be tested without waiting. Sleep returns
+// early with the context's error once it is done.
+type Clock interface {
+	Now() time.Time
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// requestBudget limits the requests made on behalf of a single user, shared by all of their devices.
+// Once Spotify answers with a Retry-After, all requests for that user are held back until it has passed.
+type requestBudget struct {
+	mu         sync.Mutex
+	limit      rate.Limit
+	burst      int
+	limiters   map[uint]*userBudget
+	lastPruned time.Time
+}
+
+type userBudget struct {
+	limiter      *rate.Limiter
+	blockedUntil time.Time
+}
+
+func newRequestBudget(requestsPerSecond float64, burst int) *requestBudget {
+	return &requestBudget{
+		limit:    rate.Limit(requestsPerSecond),
+		burst:    burst,
+		limiters: map[uint]*userBudget{},
+	}
+}
+
+// wait blocks until the next request of the user may be sent, or the context is done. If the user
+// is held back for longer than maxWait, it returns a RateLimitedError right away; if the budget
+// doesn't allow a request within maxWait, it gives up after maxWait.
+func (b *requestBudget) wait(ctx context.Context, clock Clock, userID uint, maxWait time.Duration) error {
+	now := clock.Now()
+
+	b.mu.Lock()
+	b.prune(now)
+	budget := b.get(userID)
+	limiter, blocked := budget.limiter, max(budget.blockedUntil.Sub(now), 0)
+	b.mu.Unlock()
+
+	if blocked > maxWait {
+		return &RateLimitedError{RetryAfter: blocked}
+	}
+
+	if blocked > 0 {
+		if err := clock.Sleep(ctx, blocked); err != nil {
+			return err
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait-blocked)
+	defer cancel()
+
+	if err := limiter.Wait(waitCtx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return &RateLimitedError{RetryAfter: maxWait}
+	}
+
+	return nil
+}
+
+// block holds back all requests of the user until the given time.
+func (b *requestBudget) block(userID uint, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	budget := b.get(userID)
+	if until.After(budget.blockedUntil) {
+		budget.blockedUntil = until
+	}
+}
+
+func (b *requestBudget) get(userID uint) *userBudget {
+	budget, ok := b.limiters[userID]
+	if !ok {
+		budget = &userBudget{limiter: rate.NewLimiter(b.limit, b.burst)}
+		b.limiters[userID] = budget
+	}
+
+	return budget
+}
+
+// prune drops the budgets of users that are neither held back nor have used any of their burst
+// lately. Those are no different from a fresh budget, so nothing is lost.
+func (b *requestBudget) prune(now time.Time) {
+	if now.Sub(b.lastPruned) < budgetPruneInterval {
+		return
+	}
+
+	b.lastPruned = now
+
+	for userID, budget := range b.limiters {
+		if budget.blockedUntil.Before(now) && budget.limiter.TokensAt(now) >= float64(b.burst) {
+			delete(b.limiters, userID)
+		}
+	}
+}
+
+// retryAfter parses the Retry-After header, which Spotify sends in seconds. It falls back to a
+// second if the header is missing or invalid.
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// backoff returns an exponentially growing, fully jittered delay for the given attempt.
+func backoff(attempt int) time.Duration {
+	return rand.N(retryBaseBackoff << attempt)
+}
@@ -4,24 +4,52 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/domnikl/music-box-game/backend/internal/models"
-	"github.com/domnikl/music-box-game/backend/internal/services"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/spotify"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	defaultAPIBaseURL = "https://api.spotify.com/v1"
+
+	defaultMaxPlaylistTracks = 1000
+	defaultRequestTimeout    = 10 * time.Second
+)
+
+// UserStore keeps what the client learns about a user, like refreshed tokens or the product of the
+// account. It is implemented by services.UserService.
+type UserStore interface {
+	FindUser(id uint) (*models.User, error)
+	LinkSpotify(user *models.User, accessToken, refreshToken string, expiresAt time.Time) error
+	MarkSpotifyLinkBroken(user *models.User, at time.Time) error
+	UpdateSpotifyProfile(user *models.User, profile models.SpotifyProfile) error
+	SetSpotifyProduct(user *models.User, product string) error
+	RememberDevice(user *models.User, deviceID string) error
+}
+
 type Spotify struct {
-	oauthConfig oauth2.Config
-	userService *services.UserService
+	oauthConfig       oauth2.Config
+	userService       UserStore
+	apiBaseURL        string
+	httpClient        *http.Client
+	clock             Clock
+	budget            *requestBudget
+	premiumChecks     *premiumChecks
+	refreshes         singleflight.Group
+	maxPlaylistTracks int
 }
 
-func NewSpotify(clientID, clientSecret, redirectURL string, userService *services.UserService) *Spotify {
+func NewSpotify(clientID, clientSecret, redirectURL string, userService UserStore, options ...Option) *Spotify {
 	conf := oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
@@ -30,15 +58,43 @@ func NewSpotify(clientID, clientSecret, redirectURL string, userService *service
 		RedirectURL:  redirectURL,
 	}
 
-	return &Spotify{oauthConfig: conf, userService: userService}
+	s := &Spotify{
+		oauthConfig:       conf,
+		userService:       userService,
+		apiBaseURL:        defaultAPIBaseURL,
+		httpClient:        &http.Client{Timeout: defaultRequestTimeout},
+		clock:             realClock{},
+		budget:            newRequestBudget(defaultRequestsPerSecond, defaultRequestBurst),
+		premiumChecks:     newPremiumChecks(),
+		maxPlaylistTracks: defaultMaxPlaylistTracks,
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+// AuthURL returns the URL of Spotify's authorization page. The code is bound to the PKCE verifier,
+// which has to be passed to Exchange along with it. The page is shown even if the app has been
+// authorized before, so nobody links an account without seeing which one it is.
+func (s *Spotify) AuthURL(state, verifier string) string {
+	return s.oauthConfig.AuthCodeURL(
+		state,
+		oauth2.AccessTypeOffline,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("show_dialog", "true"),
+	)
 }
 
-func (s *Spotify) AuthURL(state string) string {
-	return s.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
+func (s *Spotify) Exchange(ctx context.Context, code, verifier string) (*oauth2.Token, error) {
+	return s.oauthConfig.Exchange(s.oauthContext(ctx), code, oauth2.VerifierOption(verifier))
 }
 
-func (s *Spotify) Exchange(code string) (*oauth2.Token, error) {
-	return s.oauthConfig.Exchange(context.Background(), code)
+// oauthContext makes the oauth2 package use the configured HTTP client for requests to the token endpoint.
+func (s *Spotify) oauthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
 }
 
 type Image struct {
@@ -48,11 +104,17 @@ type Image struct {
 }
 
 type Album struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Type        string  `json:"type"`
-	ReleaseDate string  `json:"release_date"`
-	Images      []Image `json:"images"`
+	ID                   string  `json:"id"`
+	Name                 string  `json:"name"`
+	Type                 string  `json:"type"`
+	ReleaseDate          string  `json:"release_date"`
+	ReleaseDatePrecision string  `json:"release_date_precision"`
+	Images               []Image `json:"images"`
+}
+
+// Release parses the release date of the album according to its precision.
+func (a Album) Release() (models.ReleaseDate, error) {
+	return models.ParseReleaseDate(a.ReleaseDate, a.ReleaseDatePrecision)
 }
 
 type Artist struct {
@@ -71,25 +133,38 @@ type Item struct {
 	Tracks      struct {
 		Total int `json:"total"`
 	} `json:"tracks"`
-	Type    string   `json:"type"`
-	Album   Album    `json:"album"`
-	Artists []Artist `json:"artists"`
+	Type       string   `json:"type"`
+	Album      Album    `json:"album"`
+	Artists    []Artist `json:"artists"`
+	DurationMs int      `json:"duration_ms,omitempty"`
+}
+
+// Page contains the paging information Spotify returns with every list. Next and Previous are
+// URLs of the adjacent pages and empty on the first and last page.
+type Page struct {
+	Href     string `json:"href"`
+	Limit    int    `json:"limit"`
+	Offset   int    `json:"offset"`
+	Total    int    `json:"total"`
+	Next     string `json:"next"`
+	Previous string `json:"previous"`
 }
 
 type PlaylistsResponse struct {
+	Page
 	Items []Item `json:"items"`
 }
 
-func (s *Spotify) GetPlaylists(user *models.User, limit, offset int) (*PlaylistsResponse, error) {
-	resp, err := s.doRequest(http.MethodGet, "/me/playlists?limit="+strconv.Itoa(limit)+"&offset="+strconv.Itoa(offset), user, nil)
+func (s *Spotify) GetPlaylists(ctx context.Context, user *models.User, limit, offset int) (*PlaylistsResponse, error) {
+	resp, err := s.doRequest(ctx, http.MethodGet, "/me/playlists?limit="+strconv.Itoa(limit)+"&offset="+strconv.Itoa(offset), user, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get playlist: %s", resp.Status)
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("failed to get playlists: %w", err)
 	}
 
 	// json decode
@@ -102,6 +177,29 @@ func (s *Spotify) GetPlaylists(user *models.User, limit, offset int) (*Playlists
 	return &playlists, nil
 }
 
+type PlaylistTrack struct {
+	Track struct {
+		ID          string   `json:"id"`
+		Name        string   `json:"name"`
+		URI         string   `json:"uri"`
+		Artists     []Artist `json:"artists"`
+		ExternalIDs struct {
+			ISRC string `json:"isrc"`
+		} `json:"external_ids"`
+		Album struct {
+			Name                 string `json:"name"`
+			AlbumType            string `json:"album_type"`
+			ReleaseDate          string `json:"release_date"`
+			ReleaseDatePrecision string `json:"release_date_precision"`
+		} `json:"album"`
+	} `json:"track"`
+}
+
+type PlaylistTracksResponse struct {
+	Page
+	Items []PlaylistTrack `json:"items"`
+}
+
 type PlaylistResponse struct {
 	Name          string `json:"name"`
 	Description   string `json:"description"`
@@ -112,73 +210,168 @@ type PlaylistResponse struct {
 		Height int    `json:"height"`
 		Width  int    `json:"width"`
 	} `json:"images"`
-	Tracks struct {
-		Total int `json:"total"`
-		Items []struct {
-			Track struct {
-				Name  string `json:"name"`
-				Album struct {
-					Name        string `json:"name"`
-					ReleaseDate string `json:"release_date"`
-				} `json:"album"`
-			} `json:"track"`
-		} `json:"items"`
-	} `json:"tracks"`
-	Type string `json:"type"`
-	ID   string `json:"id"`
+	Tracks PlaylistTracksResponse `json:"tracks"`
+	Type   string                 `json:"type"`
+	ID     string                 `json:"id"`
+}
+
+// GameTracks converts the tracks of the playlist into tracks that can be played in a game.
+func (p *PlaylistResponse) GameTracks() []models.Track {
+	tracks := make([]models.Track, 0, len(p.Tracks.Items))
+	for _, item := range p.Tracks.Items {
+		artists := make([]string, 0, len(item.Track.Artists))
+		for _, artist := range item.Track.Artists {
+			artists = append(artists, artist.Name)
+		}
+
+		tracks = append(tracks, models.Track{
+			ID:                   item.Track.ID,
+			ISRC:                 item.Track.ExternalIDs.ISRC,
+			Name:                 item.Track.Name,
+			ArtistName:           strings.Join(artists, ", "),
+			AlbumName:            item.Track.Album.Name,
+			AlbumType:            item.Track.Album.AlbumType,
+			ReleaseDate:          item.Track.Album.ReleaseDate,
+			ReleaseDatePrecision: item.Track.Album.ReleaseDatePrecision,
+		})
+	}
+
+	return tracks
+}
+
+// GetPlaylist returns the playlist with all of its tracks by following the pages of the track list,
+// up to the configured maximum. If the playlist has been cut off, Tracks.Next points to the next page.
+func (s *Spotify) GetPlaylist(ctx context.Context, user *models.User, id string) (*PlaylistResponse, error) {
+	var playlist PlaylistResponse
+	if err := s.getJSON(ctx, "/playlists/"+id, user, &playlist); err != nil {
+		return nil, fmt.Errorf("failed to get playlist: %w", err)
+	}
+
+	for playlist.Tracks.Next != "" && len(playlist.Tracks.Items) < s.maxPlaylistTracks {
+		path, err := s.apiPath(playlist.Tracks.Next)
+		if err != nil {
+			return nil, err
+		}
+
+		var page PlaylistTracksResponse
+		if err := s.getJSON(ctx, path, user, &page); err != nil {
+			return nil, fmt.Errorf("failed to get playlist tracks: %w", err)
+		}
+
+		playlist.Tracks.Items = append(playlist.Tracks.Items, page.Items...)
+		playlist.Tracks.Next = page.Next
+	}
+
+	if len(playlist.Tracks.Items) > s.maxPlaylistTracks {
+		playlist.Tracks.Items = playlist.Tracks.Items[:s.maxPlaylistTracks]
+	}
+
+	playlist.Tracks.Offset = 0
+	playlist.Tracks.Limit = len(playlist.Tracks.Items)
+	playlist.Tracks.Previous = ""
+
+	return &playlist, nil
 }
 
-func (s *Spotify) GetPlaylist(user *models.User, id string) (*PlaylistResponse, error) {
-	resp, err := s.doRequest(http.MethodGet, "/playlists/"+id, user, nil)
+// getJSON requests the given path and decodes the JSON response into v.
+func (s *Spotify) getJSON(ctx context.Context, path string, user *models.User, v any) error {
+	resp, err := s.doRequest(ctx, http.MethodGet, path, user, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get playlist: %s %s", resp.Status, string(body))
+	if err := checkResponse(resp); err != nil {
+		return err
 	}
 
-	var playlist PlaylistResponse
-	err = json.NewDecoder(resp.Body).Decode(&playlist)
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// send sends a player command that doesn't return any content.
+func (s *Spotify) send(ctx context.Context, method string, path string, user *models.User, body []byte) error {
+	resp, err := s.doRequest(ctx, method, path, user, body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &playlist, nil
+	defer resp.Body.Close()
+
+	err = checkResponse(resp)
+	if errors.Is(err, ErrPremiumRequired) {
+		s.premiumChecks.checked(user.ID, s.clock.Now())
+
+		if user.SpotifyProfile.Product != models.SpotifyProductFree {
+			if err := s.userService.SetSpotifyProduct(user, models.SpotifyProductFree); err != nil {
+				slog.Warn("Failed to store the product of the Spotify account: " + err.Error())
+			}
+		}
+	}
+
+	return err
 }
 
-func (s *Spotify) Next(user *models.User) error {
-	resp, err := s.doRequest(http.MethodPost, "/me/player/next", user, nil)
-	if err != nil {
+// requirePremium returns ErrPremiumRequired without bothering Spotify with a player command if the
+// account of the user is known to lack Premium. Once premiumRecheckInterval has passed since the last
+// check, the profile is refreshed first, so upgraded accounts can control playback again.
+func (s *Spotify) requirePremium(ctx context.Context, user *models.User) error {
+	if !user.SpotifyPremiumRequired() {
+		return nil
+	}
+
+	now := s.clock.Now()
+	if !s.premiumChecks.due(user.ID, now) {
+		return ErrPremiumRequired
+	}
+
+	if err := s.RefreshProfile(ctx, user); err != nil {
 		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to skip track: %s %s", resp.Status, string(body))
+	if user.SpotifyPremiumRequired() {
+		s.premiumChecks.checked(user.ID, now)
+		return ErrPremiumRequired
 	}
 
 	return nil
 }
 
-func (s *Spotify) Pause(user *models.User) error {
-	resp, err := s.doRequest(http.MethodPut, "/me/player/pause", user, nil)
-	if err != nil {
+// apiPath turns a URL returned by Spotify (e.g. the next page of a list) into a path for doRequest.
+func (s *Spotify) apiPath(rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, s.apiBaseURL+"/") {
+		return "", fmt.Errorf("unexpected Spotify URL: %s", rawURL)
+	}
+
+	return strings.TrimPrefix(rawURL, s.apiBaseURL), nil
+}
+
+func (s *Spotify) Next(ctx context.Context, user *models.User) error {
+	if err := s.requirePremium(ctx, user); err != nil {
 		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to pause playback: %s %s", resp.Status, string(body))
+	if err := s.send(ctx, http.MethodPost, "/me/player/next", user, nil); err != nil {
+		return fmt.Errorf("failed to skip track: %w", err)
 	}
 
 	return nil
 }
 
-func (s *Spotify) Play(user *models.User, deviceID string, playlistID string) error {
+func (s *Spotify) Pause(ctx context.Context, user *models.User) error {
+	if err := s.requirePremium(ctx, user); err != nil {
+		return err
+	}
+
+	if err := s.send(ctx, http.MethodPut, "/me/player/pause", user, nil); err != nil {
+		return fmt.Errorf("failed to pause playback: %w", err)
+	}
+
+	return nil
+}
+
+// Play starts the playlist on the given device. Without a device, the one picked by selectDevice is used.
+func (s *Spotify) Play(ctx context.Context, user *models.User, deviceID string, playlistID string) error {
 	type playRequest struct {
 		ContextURI string `json:"context_uri,omitempty"`
 	}
@@ -192,14 +385,106 @@ func (s *Spotify) Play(user *models.User, deviceID string, playlistID string) er
 		return err
 	}
 
-	resp, err := s.doRequest(http.MethodPut, fmt.Sprintf("/me/player/play?device_id=%s", deviceID), user, body)
+	if err := s.startPlayback(ctx, user, deviceID, body); err != nil {
+		return fmt.Errorf("failed to start playback: %w", err)
+	}
+
+	return nil
+}
+
+// PlayTrack plays a single track on the given device. Without a device, the one picked by selectDevice is used.
+func (s *Spotify) PlayTrack(ctx context.Context, user *models.User, deviceID string, trackID string) error {
+	type playRequest struct {
+		URIs []string `json:"uris"`
+	}
+
+	body, err := json.Marshal(playRequest{URIs: []string{"spotify:track:" + trackID}})
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to start playback: %s %s", resp.Status, string(body))
+	if err := s.startPlayback(ctx, user, deviceID, body); err != nil {
+		return fmt.Errorf("failed to play track: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Spotify) startPlayback(ctx context.Context, user *models.User, deviceID string, body []byte) error {
+	if err := s.requirePremium(ctx, user); err != nil {
+		return err
+	}
+
+	if deviceID == "" {
+		var err error
+		if deviceID, err = s.selectDevice(ctx, user); err != nil {
+			return err
+		}
+	}
+
+	err := s.send(ctx, http.MethodPut, "/me/player/play?device_id="+url.QueryEscape(deviceID), user, body)
+	if err != nil {
+		return err
+	}
+
+	if deviceID != user.LastDeviceID {
+		if err := s.userService.RememberDevice(user, deviceID); err != nil {
+			slog.Warn("Failed to remember last used device: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// selectDevice picks a device to play on if the client didn't ask for a specific one: the active device,
+// otherwise the user's preferred or last used device, or the only device available. Playback is
+// transferred to an inactive device before it is used. ErrNoActiveDevice is returned if none is reachable.
+func (s *Spotify) selectDevice(ctx context.Context, user *models.User) (string, error) {
+	devices, err := s.GetDevices(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
+	for _, device := range devices {
+		if device.IsActive {
+			return device.ID, nil
+		}
+	}
+
+	candidates := []string{user.PreferredDeviceID, user.LastDeviceID}
+	if len(devices) == 1 {
+		candidates = append(candidates, devices[0].ID)
+	}
+
+	for _, candidate := range candidates {
+		for _, device := range devices {
+			if candidate != "" && device.ID == candidate {
+				return device.ID, s.TransferPlayback(ctx, user, device.ID)
+			}
+		}
+	}
+
+	return "", ErrNoActiveDevice
+}
+
+// TransferPlayback makes the given device the active one without starting playback.
+func (s *Spotify) TransferPlayback(ctx context.Context, user *models.User, deviceID string) error {
+	type transferRequest struct {
+		DeviceIDs []string `json:"device_ids"`
+		Play      bool     `json:"play"`
+	}
+
+	if err := s.requirePremium(ctx, user); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(transferRequest{DeviceIDs: []string{deviceID}})
+	if err != nil {
+		return err
+	}
+
+	if err := s.send(ctx, http.MethodPut, "/me/player", user, body); err != nil {
+		return fmt.Errorf("failed to transfer playback: %w", err)
 	}
 
 	return nil
@@ -214,80 +499,153 @@ type Device struct {
 	SupportsVolume bool   `json:"supports_volume"`
 }
 
-type DevicesResponse struct {
-	Devices []Device `json:"devices"`
+type Profile struct {
+	ID          string  `json:"id"`
+	DisplayName string  `json:"display_name"`
+	Country     string  `json:"country"`
+	Product     string  `json:"product"`
+	Images      []Image `json:"images"`
 }
 
-func (s *Spotify) GetDevices(user *models.User) ([]Device, error) {
-	resp, err := s.doRequest(http.MethodGet, "/me/player/devices", user, nil)
-	if err != nil {
-		return nil, err
+// SpotifyProfile converts the profile into the one stored with the user, using the largest image as avatar.
+func (p *Profile) SpotifyProfile() models.SpotifyProfile {
+	profile := models.SpotifyProfile{
+		UserID:      p.ID,
+		DisplayName: p.DisplayName,
+		Country:     p.Country,
+		Product:     p.Product,
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get devices: %s", resp.Status)
+	largest := 0
+	for _, image := range p.Images {
+		if profile.AvatarURL == "" || image.Width > largest {
+			profile.AvatarURL = image.URL
+			largest = image.Width
+		}
 	}
 
-	// json decode
-	var response DevicesResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		return nil, err
+	return profile
+}
+
+// GetProfile returns the profile of the Spotify account the user has linked.
+func (s *Spotify) GetProfile(ctx context.Context, user *models.User) (*Profile, error) {
+	var profile Profile
+	if err := s.getJSON(ctx, "/me", user, &profile); err != nil {
+		return nil, fmt.Errorf("failed to get profile: %w", err)
 	}
 
-	return response.Devices, nil
+	return &profile, nil
 }
 
-func (s *Spotify) doRequest(method string, path string, user *models.User, body []byte, refreshTokens ...bool) (*http.Response, error) {
-	httpClient := &http.Client{}
-	url, err := url.Parse("https://api.spotify.com/v1" + path)
+// RefreshProfile fetches the profile of the user's Spotify account and stores it, so changes like an
+// upgrade to Premium are picked up.
+func (s *Spotify) RefreshProfile(ctx context.Context, user *models.User) error {
+	profile, err := s.GetProfile(ctx, user)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	request := &http.Request{
-		Method: method,
-		URL:    url,
-		Header: http.Header{
-			"Authorization": []string{"Bearer " + user.SpotifyToken},
-		},
-		Body: io.NopCloser(bytes.NewReader(body)),
-	}
+	return s.userService.UpdateSpotifyProfile(user, profile.SpotifyProfile())
+}
 
-	resp, err := httpClient.Do(request)
-	if err != nil {
-		return resp, err
-	}
+type DevicesResponse struct {
+	Devices []Device `json:"devices"`
+}
 
-	if resp.StatusCode == http.StatusUnauthorized && refreshTokens == nil {
-		s.refreshToken(user)
-		return s.doRequest(method, path, user, body, false)
+func (s *Spotify) GetDevices(ctx context.Context, user *models.User) ([]Device, error) {
+	var response DevicesResponse
+	if err := s.getJSON(ctx, "/me/player/devices", user, &response); err != nil {
+		return nil, fmt.Errorf("failed to get devices: %w", err)
 	}
 
-	return resp, nil
+	return response.Devices, nil
 }
 
-func (s *Spotify) refreshToken(user *models.User) error {
-	tokenSource := s.oauthConfig.TokenSource(context.Background(), &oauth2.Token{
-		RefreshToken: user.SpotifyRefreshToken,
-	})
+// doRequest sends a request to the Web API on behalf of the user. Every request counts against the
+// user's request budget. GET requests are retried with backoff if Spotify is rate limiting or
+// temporarily unavailable; if that doesn't help, a RateLimitedError is returned. If Spotify rejects
+// the access token, it is refreshed and the request is sent once more.
+func (s *Spotify) doRequest(ctx context.Context, method string, path string, user *models.User, body []byte) (*http.Response, error) {
+	return s.sendRequest(ctx, method, path, user, body, true)
+}
 
-	token, err := tokenSource.Token()
+// sendRequest implements doRequest. refreshOnUnauthorized tells whether the token may still be refreshed
+// if Spotify rejects it, which is only done once per request.
+func (s *Spotify) sendRequest(ctx context.Context, method string, path string, user *models.User, body []byte, refreshOnUnauthorized bool) (*http.Response, error) {
+	url, err := url.Parse(s.apiBaseURL + path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	user.SpotifyToken = token.AccessToken
-	user.SpotifyRefreshToken = token.RefreshToken
+	if s.tokenExpiresSoon(user) {
+		if err := s.refreshToken(ctx, user); err != nil {
+			return nil, err
+		}
+	}
 
-	// only update specific fields
-	s.userService.UpdateUser(&models.User{
-		ID:                  user.ID,
-		SpotifyToken:        user.SpotifyToken,
-		SpotifyRefreshToken: user.SpotifyRefreshToken,
-	})
+	for attempt := 0; ; attempt++ {
+		if err := s.budget.wait(ctx, s.clock, user.ID, maxRetryWait); err != nil {
+			return nil, err
+		}
 
-	return nil
+		request, err := http.NewRequestWithContext(ctx, method, url.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("Authorization", "Bearer "+user.SpotifyToken)
+
+		retryable := method == http.MethodGet && attempt < maxRetries
+
+		resp, err := s.httpClient.Do(request)
+		if err != nil {
+			if retryable && ctx.Err() == nil {
+				if err := s.clock.Sleep(ctx, backoff(attempt)); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && refreshOnUnauthorized:
+			resp.Body.Close()
+			if err := s.refreshToken(ctx, user); err != nil {
+				return nil, err
+			}
+
+			return s.sendRequest(ctx, method, path, user, body, false)
+
+		case resp.StatusCode == http.StatusTooManyRequests:
+			resp.Body.Close()
+			delay := retryAfter(resp.Header)
+			s.budget.block(user.ID, s.clock.Now().Add(delay))
+
+			if !retryable || delay > maxRetryWait {
+				return nil, &RateLimitedError{RetryAfter: delay}
+			}
+
+			// the budget makes the next attempt wait for Retry-After, jitter spreads out concurrent retries
+			if err := s.clock.Sleep(ctx, backoff(attempt)); err != nil {
+				return nil, err
+			}
+
+			continue
+
+		case resp.StatusCode >= http.StatusInternalServerError && retryable:
+			resp.Body.Close()
+			if err := s.clock.Sleep(ctx, backoff(attempt)); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		return resp, nil
+	}
 }
 
 type CurrentlyPlayingResponse struct {
@@ -301,14 +659,21 @@ type CurrentlyPlayingResponse struct {
 	Item                 Item    `json:"item"`
 }
 
-func (s *Spotify) GetCurrentlyPlaying(user *models.User) (*CurrentlyPlayingResponse, error) {
-	resp, err := s.doRequest(http.MethodGet, "/me/player/currently-playing?market=DE", user, nil)
+func (s *Spotify) GetCurrentlyPlaying(ctx context.Context, user *models.User) (*CurrentlyPlayingResponse, error) {
+	resp, err := s.doRequest(ctx, http.MethodGet, "/me/player/currently-playing?market=DE", user, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get currently playing: %s", resp.Status)
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("failed to get currently playing: %w", err)
+	}
+
+	// nothing is playing at all
+	if resp.StatusCode == http.StatusNoContent {
+		return &CurrentlyPlayingResponse{}, nil
 	}
 
 	// json decode
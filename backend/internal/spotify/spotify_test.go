@@ -0,0 +1,362 @@
+package spotify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+	"github.com/domnikl/music-box-game/backend/internal/spotify/spotifytest"
+)
+
+// memoryUsers is a UserStore that keeps users in memory.
+type memoryUsers struct {
+	mu    sync.Mutex
+	users map[uint]models.User
+}
+
+func newMemoryUsers(users ...*models.User) *memoryUsers {
+	m := &memoryUsers{users: map[uint]models.User{}}
+	for _, user := range users {
+		m.users[user.ID] = *user
+	}
+
+	return m
+}
+
+func (m *memoryUsers) get(id uint) models.User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.users[id]
+}
+
+func (m *memoryUsers) update(user *models.User, change func(u *models.User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	change(user)
+	stored := m.users[user.ID]
+	change(&stored)
+	m.users[user.ID] = stored
+}
+
+func (m *memoryUsers) FindUser(id uint) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, fmt.Errorf("user %d not found", id)
+	}
+
+	return &user, nil
+}
+
+func (m *memoryUsers) LinkSpotify(user *models.User, accessToken, refreshToken string, expiresAt time.Time) error {
+	m.update(user, func(u *models.User) {
+		u.SpotifyToken = accessToken
+		u.SpotifyRefreshToken = refreshToken
+		u.SpotifyTokenExpiresAt = &expiresAt
+		u.SpotifyLinkBrokenAt = nil
+	})
+
+	return nil
+}
+
+func (m *memoryUsers) MarkSpotifyLinkBroken(user *models.User, at time.Time) error {
+	m.update(user, func(u *models.User) { u.SpotifyLinkBrokenAt = &at })
+
+	return nil
+}
+
+func (m *memoryUsers) UpdateSpotifyProfile(user *models.User, profile models.SpotifyProfile) error {
+	m.update(user, func(u *models.User) { u.SpotifyProfile = profile })
+
+	return nil
+}
+
+func (m *memoryUsers) SetSpotifyProduct(user *models.User, product string) error {
+	m.update(user, func(u *models.User) { u.SpotifyProfile.Product = product })
+
+	return nil
+}
+
+func (m *memoryUsers) RememberDevice(user *models.User, deviceID string) error {
+	m.update(user, func(u *models.User) { u.LastDeviceID = deviceID })
+
+	return nil
+}
+
+// newClient returns a client talking to a fake Spotify and a user who has just linked it.
+func newClient(t *testing.T, options ...spotify.Option) (*spotify.Spotify, *spotifytest.Server, *memoryUsers, *models.User) {
+	t.Helper()
+
+	server := spotifytest.NewServer()
+	t.Cleanup(server.Close)
+
+	accessToken, refreshToken := server.IssueTokens()
+	expiresAt := time.Now().Add(time.Hour)
+	user := &models.User{ID: 1, SpotifyToken: accessToken, SpotifyRefreshToken: refreshToken, SpotifyTokenExpiresAt: &expiresAt}
+	users := newMemoryUsers(user)
+
+	options = append(server.Options(), options...)
+	client := spotify.NewSpotify(spotifytest.ClientID, spotifytest.ClientSecret, "http://localhost/callback", users, options...)
+
+	return client, server, users, user
+}
+
+func TestRefreshesTokenBeforeItExpires(t *testing.T) {
+	client, _, users, user := newClient(t)
+
+	expiresAt := time.Now().Add(10 * time.Second)
+	users.update(user, func(u *models.User) { u.SpotifyTokenExpiresAt = &expiresAt })
+	previous := user.SpotifyToken
+
+	if _, err := client.GetDevices(context.Background(), user); err != nil {
+		t.Fatalf("GetDevices() error = %v", err)
+	}
+
+	if user.SpotifyToken == previous {
+		t.Error("access token has not been refreshed")
+	}
+
+	if stored := users.get(user.ID); stored.SpotifyToken != user.SpotifyToken {
+		t.Errorf("stored access token = %q, want %q", stored.SpotifyToken, user.SpotifyToken)
+	}
+}
+
+func TestRefreshesTokenRejectedBySpotify(t *testing.T) {
+	client, server, _, user := newClient(t)
+	previous := user.SpotifyToken
+
+	server.ExpireAccessTokens()
+
+	if _, err := client.GetDevices(context.Background(), user); err != nil {
+		t.Fatalf("GetDevices() error = %v", err)
+	}
+
+	if user.SpotifyToken == previous {
+		t.Error("access token has not been refreshed")
+	}
+
+	if got := server.Requests("GET /v1/me/player/devices"); got != 2 {
+		t.Errorf("devices requested %d times, want 2", got)
+	}
+}
+
+// fakeClock is a Clock that only moves on when it is advanced and doesn't sleep.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, _ time.Duration) error { return ctx.Err() }
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestRevokedRefreshTokenBreaksLink(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	client, server, users, user := newClient(t, spotify.WithClock(&fakeClock{now: now}))
+
+	server.RevokeRefreshTokens()
+
+	if _, err := client.GetDevices(context.Background(), user); !errors.Is(err, spotify.ErrTokenRevoked) {
+		t.Fatalf("GetDevices() error = %v, want %v", err, spotify.ErrTokenRevoked)
+	}
+
+	stored := users.get(user.ID)
+	if !stored.SpotifyLinkBroken() {
+		t.Fatal("Spotify link has not been marked as broken")
+	}
+
+	if !stored.SpotifyLinkBrokenAt.Equal(now) {
+		t.Errorf("Spotify link broken at %s, want %s", *stored.SpotifyLinkBrokenAt, now)
+	}
+}
+
+func TestRetriesRateLimitedRequests(t *testing.T) {
+	client, server, _, user := newClient(t)
+
+	server.RateLimit(2, 0)
+
+	if _, err := client.GetDevices(context.Background(), user); err != nil {
+		t.Fatalf("GetDevices() error = %v", err)
+	}
+
+	if got := server.Requests("GET /v1/me/player/devices"); got != 3 {
+		t.Errorf("devices requested %d times, want 3", got)
+	}
+}
+
+func TestReturnsRetryAfterWhenRateLimitedForLong(t *testing.T) {
+	client, server, _, user := newClient(t)
+
+	server.RateLimit(1, 30)
+
+	_, err := client.GetDevices(context.Background(), user)
+
+	var rateLimited *spotify.RateLimitedError
+	if !errors.As(err, &rateLimited) {
+		t.Fatalf("GetDevices() error = %v, want a RateLimitedError", err)
+	}
+
+	if rateLimited.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter = %s, want 30s", rateLimited.RetryAfter)
+	}
+
+	if got := server.Requests("GET /v1/me/player/devices"); got != 1 {
+		t.Errorf("devices requested %d times, want 1", got)
+	}
+
+	// the user's requests are held back until Retry-After has passed, without asking Spotify again
+	if _, err := client.GetDevices(context.Background(), user); !errors.As(err, &rateLimited) {
+		t.Fatalf("second GetDevices() error = %v, want a RateLimitedError", err)
+	}
+
+	if got := server.Requests("GET /v1/me/player/devices"); got != 1 {
+		t.Errorf("devices requested %d times, want 1", got)
+	}
+}
+
+func TestStopsWaitingForRetryAfterOnceContextIsDone(t *testing.T) {
+	client, server, _, user := newClient(t)
+
+	server.RateLimit(1, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := client.GetDevices(ctx, user); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetDevices() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("GetDevices() returned after %s, want it to stop waiting with the context", waited)
+	}
+}
+
+func TestPremiumRequiredMarksAccountAsFree(t *testing.T) {
+	client, server, users, user := newClient(t)
+
+	server.SetPremium(false)
+	server.SetDevices(spotifytest.Device{ID: "phone", Name: "Phone", Type: "Smartphone", IsActive: true})
+
+	if err := client.Pause(context.Background(), user); !errors.Is(err, spotify.ErrPremiumRequired) {
+		t.Fatalf("Pause() error = %v, want %v", err, spotify.ErrPremiumRequired)
+	}
+
+	if stored := users.get(user.ID); stored.SpotifyProfile.Product != models.SpotifyProductFree {
+		t.Errorf("stored product = %q, want %q", stored.SpotifyProfile.Product, models.SpotifyProductFree)
+	}
+}
+
+func TestFreeAccountIsOnlyCheckedAgainAfterInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	client, server, users, user := newClient(t, spotify.WithClock(clock))
+
+	server.SetPremium(false)
+	server.SetDevices(spotifytest.Device{ID: "phone", Name: "Phone", Type: "Smartphone", IsActive: true})
+	users.update(user, func(u *models.User) { u.SpotifyProfile.Product = models.SpotifyProductFree })
+
+	for range 2 {
+		if err := client.Pause(context.Background(), user); !errors.Is(err, spotify.ErrPremiumRequired) {
+			t.Fatalf("Pause() error = %v, want %v", err, spotify.ErrPremiumRequired)
+		}
+	}
+
+	if got := server.Requests("GET /v1/me"); got != 1 {
+		t.Errorf("profile requested %d times, want 1", got)
+	}
+
+	server.SetPremium(true)
+	clock.advance(10 * time.Minute)
+
+	if err := client.Pause(context.Background(), user); err != nil {
+		t.Fatalf("Pause() after upgrading error = %v", err)
+	}
+
+	if got := server.Requests("GET /v1/me"); got != 2 {
+		t.Errorf("profile requested %d times, want 2", got)
+	}
+}
+
+func TestNoActiveDevice(t *testing.T) {
+	client, server, _, user := newClient(t)
+
+	if err := client.PlayTrack(context.Background(), user, "", "track"); !errors.Is(err, spotify.ErrNoActiveDevice) {
+		t.Errorf("PlayTrack() without devices error = %v, want %v", err, spotify.ErrNoActiveDevice)
+	}
+
+	server.SetDevices(spotifytest.Device{ID: "phone", Name: "Phone", Type: "Smartphone"})
+
+	if err := client.Pause(context.Background(), user); !errors.Is(err, spotify.ErrNoActiveDevice) {
+		t.Errorf("Pause() without active device error = %v, want %v", err, spotify.ErrNoActiveDevice)
+	}
+}
+
+func TestPlayTransfersToOnlyDevice(t *testing.T) {
+	client, server, users, user := newClient(t)
+
+	server.SetDevices(spotifytest.Device{ID: "phone", Name: "Phone", Type: "Smartphone"})
+
+	if err := client.PlayTrack(context.Background(), user, "", "track"); err != nil {
+		t.Fatalf("PlayTrack() error = %v", err)
+	}
+
+	if !server.IsPlaying() {
+		t.Error("playback has not been started")
+	}
+
+	if stored := users.get(user.ID); stored.LastDeviceID != "phone" {
+		t.Errorf("last device = %q, want %q", stored.LastDeviceID, "phone")
+	}
+}
+
+func TestGetPlaylistFollowsPages(t *testing.T) {
+	playlist := spotifytest.Playlist{ID: "playlist", Name: "Playlist"}
+	for i := range 250 {
+		playlist.Tracks = append(playlist.Tracks, spotifytest.Track{ID: fmt.Sprintf("track-%d", i), ReleaseDate: "1987"})
+	}
+
+	client, server, _, user := newClient(t)
+	server.AddPlaylist(playlist)
+
+	got, err := client.GetPlaylist(context.Background(), user, "playlist")
+	if err != nil {
+		t.Fatalf("GetPlaylist() error = %v", err)
+	}
+
+	if len(got.Tracks.Items) != 250 || got.Tracks.Next != "" {
+		t.Errorf("GetPlaylist() returned %d tracks with next %q, want all 250", len(got.Tracks.Items), got.Tracks.Next)
+	}
+
+	limited, server, _, user := newClient(t, spotify.WithMaxPlaylistTracks(120))
+	server.AddPlaylist(playlist)
+
+	got, err = limited.GetPlaylist(context.Background(), user, "playlist")
+	if err != nil {
+		t.Fatalf("GetPlaylist() error = %v", err)
+	}
+
+	if len(got.Tracks.Items) != 120 || got.Tracks.Next == "" {
+		t.Errorf("GetPlaylist() returned %d tracks with next %q, want 120 and a next page", len(got.Tracks.Items), got.Tracks.Next)
+	}
+}
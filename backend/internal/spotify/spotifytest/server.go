@@ -0,0 +1,625 @@
+// Package spotifytest provides a fake Spotify server that implements the parts of the Web API and the
+// accounts service used by this application, so the spotify package and the controllers can be tested
+// without network access.
+package spotifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/domnikl/music-box-game/backend/internal/spotify"
+)
+
+const (
+	ClientID     = "spotifytest-client"
+	ClientSecret = "spotifytest-secret"
+	// UserID is the ID of the account of the fake server
+	UserID = "spotifytest-user"
+
+	defaultPageSize = 100
+)
+
+type Track struct {
+	ID                   string
+	Name                 string
+	Artists              []string
+	AlbumName            string
+	AlbumType            string
+	ReleaseDate          string
+	ReleaseDatePrecision string
+	ISRC                 string
+	DurationMs           int
+}
+
+type Playlist struct {
+	ID     string
+	Name   string
+	Tracks []Track
+}
+
+type Device struct {
+	ID       string
+	Name     string
+	Type     string
+	IsActive bool
+}
+
+// Server is a fake Spotify for a single account. Its state is changed through its methods, which are safe
+// to call while requests are being served.
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	playlists     []Playlist
+	devices       []Device
+	premium       bool
+	isPlaying     bool
+	currentTrack  *Track
+	progressMs    int
+	accessTokens  map[string]bool
+	refreshTokens map[string]bool
+	issued        int
+	requests      map[string]int
+	rateLimited   int
+	retryAfter    int
+}
+
+// NewServer starts a fake Spotify server. It must be closed by the caller.
+func NewServer() *Server {
+	s := &Server{
+		premium:       true,
+		accessTokens:  map[string]bool{},
+		refreshTokens: map[string]bool{},
+		requests:      map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/token", s.handleToken)
+	mux.HandleFunc("GET /v1/me", s.authorized(s.handleProfile))
+	mux.HandleFunc("GET /v1/me/playlists", s.authorized(s.handlePlaylists))
+	mux.HandleFunc("GET /v1/playlists/{id}", s.authorized(s.handlePlaylist))
+	mux.HandleFunc("GET /v1/playlists/{id}/tracks", s.authorized(s.handlePlaylistTracks))
+	mux.HandleFunc("GET /v1/me/player/devices", s.authorized(s.handleDevices))
+	mux.HandleFunc("GET /v1/me/player/currently-playing", s.authorized(s.handleCurrentlyPlaying))
+	mux.HandleFunc("PUT /v1/me/player", s.authorized(s.premiumOnly(s.handleTransfer)))
+	mux.HandleFunc("PUT /v1/me/player/play", s.authorized(s.premiumOnly(s.handlePlay)))
+	mux.HandleFunc("PUT /v1/me/player/pause", s.authorized(s.premiumOnly(s.handlePause)))
+	mux.HandleFunc("POST /v1/me/player/next", s.authorized(s.premiumOnly(s.handleNext)))
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Options configures a spotify.Spotify client to talk to this server.
+func (s *Server) Options() []spotify.Option {
+	return []spotify.Option{
+		spotify.WithAPIBaseURL(s.URL + "/v1"),
+		spotify.WithTokenEndpoint(s.URL+"/authorize", s.URL+"/api/token"),
+		spotify.WithHTTPClient(s.Client()),
+	}
+}
+
+// IssueTokens creates a valid pair of access and refresh tokens, as if the user had just linked Spotify.
+func (s *Server) IssueTokens() (accessToken, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issueTokens()
+}
+
+// ExpireAccessTokens invalidates all access tokens, so the next request has to refresh them.
+func (s *Server) ExpireAccessTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accessTokens = map[string]bool{}
+}
+
+// RevokeRefreshTokens invalidates all refresh tokens, as if the user had removed the app from their account.
+func (s *Server) RevokeRefreshTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accessTokens = map[string]bool{}
+	s.refreshTokens = map[string]bool{}
+}
+
+func (s *Server) AddPlaylist(playlist Playlist) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.playlists = append(s.playlists, playlist)
+}
+
+func (s *Server) SetDevices(devices ...Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.devices = devices
+}
+
+// SetPremium switches the account between Spotify Premium and Free. Free accounts can't control playback.
+func (s *Server) SetPremium(premium bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.premium = premium
+}
+
+func (s *Server) SetPlayback(track *Track, isPlaying bool, progressMs int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.currentTrack = track
+	s.isPlaying = isPlaying
+	s.progressMs = progressMs
+}
+
+// IsPlaying reports whether playback has been started on one of the devices.
+func (s *Server) IsPlaying() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.isPlaying
+}
+
+// RateLimit answers the next n Web API requests with 429 Too Many Requests and the given Retry-After.
+func (s *Server) RateLimit(n int, retryAfterSeconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimited = n
+	s.retryAfter = retryAfterSeconds
+}
+
+// Requests returns how often the given endpoint (e.g. "GET /v1/me/player/devices") has been called.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[endpoint]
+}
+
+func (s *Server) issueTokens() (string, string) {
+	s.issued++
+	accessToken := fmt.Sprintf("access-%d", s.issued)
+	refreshToken := fmt.Sprintf("refresh-%d", s.issued)
+
+	s.accessTokens[accessToken] = true
+	s.refreshTokens[refreshToken] = true
+
+	return accessToken, refreshToken
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != ClientID || clientSecret != ClientSecret {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		if r.PostFormValue("code") == "" {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		if !s.refreshTokens[r.PostFormValue("refresh_token")] {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	accessToken, refreshToken := s.issueTokens()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": refreshToken,
+		"scope":         "user-read-email",
+	})
+}
+
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.Pattern]++
+		valid := s.accessTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		rateLimited := s.rateLimited > 0
+		if rateLimited {
+			s.rateLimited--
+		}
+		retryAfter := s.retryAfter
+		s.mu.Unlock()
+
+		if rateLimited {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, http.StatusTooManyRequests, "API rate limit exceeded", "")
+			return
+		}
+
+		if !valid {
+			writeError(w, http.StatusUnauthorized, "The access token expired", "")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *Server) premiumOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		premium := s.premium
+		s.mu.Unlock()
+
+		if !premium {
+			writeError(w, http.StatusForbidden, "Player command failed: Premium required", "PREMIUM_REQUIRED")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	product := "free"
+	if s.premium {
+		product = "premium"
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":           UserID,
+		"display_name": "Spotify Test",
+		"country":      "DE",
+		"product":      product,
+		"type":         "user",
+		"images":       []map[string]any{{"url": "https://i.scdn.co/image/spotifytest", "height": 300, "width": 300}},
+	})
+}
+
+func (s *Server) handlePlaylists(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, limit := paging(r, 20)
+	items := []map[string]any{}
+	for i := offset; i < len(s.playlists) && i < offset+limit; i++ {
+		playlist := s.playlists[i]
+		items = append(items, map[string]any{
+			"id":     playlist.ID,
+			"name":   playlist.Name,
+			"type":   "playlist",
+			"public": false,
+			"tracks": map[string]any{"total": len(playlist.Tracks)},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, s.page(r, "/v1/me/playlists", items, offset, limit, len(s.playlists)))
+}
+
+func (s *Server) handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	playlist := s.findPlaylist(r.PathValue("id"))
+	if playlist == nil {
+		writeError(w, http.StatusNotFound, "Resource not found", "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":     playlist.ID,
+		"name":   playlist.Name,
+		"type":   "playlist",
+		"tracks": s.trackPage(r, playlist, 0, defaultPageSize),
+	})
+}
+
+func (s *Server) handlePlaylistTracks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	playlist := s.findPlaylist(r.PathValue("id"))
+	if playlist == nil {
+		writeError(w, http.StatusNotFound, "Resource not found", "")
+		return
+	}
+
+	offset, limit := paging(r, defaultPageSize)
+	writeJSON(w, http.StatusOK, s.trackPage(r, playlist, offset, limit))
+}
+
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := []map[string]any{}
+	for _, device := range s.devices {
+		devices = append(devices, renderDevice(device))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func (s *Server) handleCurrentlyPlaying(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.currentTrack == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	response := map[string]any{
+		"is_playing":             s.isPlaying,
+		"progress_ms":            s.progressMs,
+		"currently_playing_type": "track",
+		"item":                   renderTrack(*s.currentTrack),
+	}
+
+	if device := s.activeDevice(); device != nil {
+		response["device"] = renderDevice(*device)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handlePlay(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.selectDevice(r.URL.Query().Get("device_id")) {
+		writeError(w, http.StatusNotFound, "Player command failed: No active device found", "NO_ACTIVE_DEVICE")
+		return
+	}
+
+	var body struct {
+		ContextURI string   `json:"context_uri"`
+		URIs       []string `json:"uris"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	if len(body.URIs) > 0 {
+		s.currentTrack = s.findTrack(strings.TrimPrefix(body.URIs[0], "spotify:track:"))
+	} else if playlist := s.findPlaylist(strings.TrimPrefix(body.ContextURI, "spotify:playlist:")); playlist != nil && len(playlist.Tracks) > 0 {
+		s.currentTrack = &playlist.Tracks[0]
+	}
+
+	s.isPlaying = true
+	s.progressMs = 0
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		DeviceIDs []string `json:"device_ids"`
+		Play      bool     `json:"play"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.DeviceIDs) != 1 {
+		writeError(w, http.StatusBadRequest, "Invalid device_ids", "")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.selectDevice(body.DeviceIDs[0]) {
+		writeError(w, http.StatusNotFound, "Device not found", "")
+		return
+	}
+
+	if body.Play {
+		s.isPlaying = true
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeDevice() == nil {
+		writeError(w, http.StatusNotFound, "Player command failed: No active device found", "NO_ACTIVE_DEVICE")
+		return
+	}
+
+	s.isPlaying = false
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleNext(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeDevice() == nil {
+		writeError(w, http.StatusNotFound, "Player command failed: No active device found", "NO_ACTIVE_DEVICE")
+		return
+	}
+
+	s.progressMs = 0
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// selectDevice makes the given device active. Without an ID, the currently active device is used.
+func (s *Server) selectDevice(id string) bool {
+	if id == "" {
+		return s.activeDevice() != nil
+	}
+
+	found := false
+	for i := range s.devices {
+		s.devices[i].IsActive = s.devices[i].ID == id
+		found = found || s.devices[i].IsActive
+	}
+
+	return found
+}
+
+func (s *Server) activeDevice() *Device {
+	for i := range s.devices {
+		if s.devices[i].IsActive {
+			return &s.devices[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) findPlaylist(id string) *Playlist {
+	for i := range s.playlists {
+		if s.playlists[i].ID == id {
+			return &s.playlists[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) findTrack(id string) *Track {
+	for i := range s.playlists {
+		for j := range s.playlists[i].Tracks {
+			if s.playlists[i].Tracks[j].ID == id {
+				return &s.playlists[i].Tracks[j]
+			}
+		}
+	}
+
+	return &Track{ID: id}
+}
+
+func (s *Server) trackPage(r *http.Request, playlist *Playlist, offset, limit int) map[string]any {
+	items := []map[string]any{}
+	for i := offset; i < len(playlist.Tracks) && i < offset+limit; i++ {
+		items = append(items, map[string]any{"track": renderTrack(playlist.Tracks[i])})
+	}
+
+	return s.page(r, "/v1/playlists/"+playlist.ID+"/tracks", items, offset, limit, len(playlist.Tracks))
+}
+
+// page wraps items into a Spotify paging object with absolute next and previous URLs.
+func (s *Server) page(r *http.Request, path string, items []map[string]any, offset, limit, total int) map[string]any {
+	pageURL := func(offset int) string {
+		return fmt.Sprintf("http://%s%s?offset=%d&limit=%d", r.Host, path, offset, limit)
+	}
+
+	page := map[string]any{
+		"href":     pageURL(offset),
+		"items":    items,
+		"limit":    limit,
+		"offset":   offset,
+		"total":    total,
+		"next":     nil,
+		"previous": nil,
+	}
+
+	if offset+limit < total {
+		page["next"] = pageURL(offset + limit)
+	}
+
+	if offset > 0 {
+		page["previous"] = pageURL(max(offset-limit, 0))
+	}
+
+	return page
+}
+
+func paging(r *http.Request, defaultLimit int) (offset, limit int) {
+	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+
+	return max(offset, 0), limit
+}
+
+func renderTrack(track Track) map[string]any {
+	artists := []map[string]any{}
+	for i, name := range track.Artists {
+		artists = append(artists, map[string]any{
+			"id":   fmt.Sprintf("%s-artist-%d", track.ID, i),
+			"name": name,
+			"type": "artist",
+		})
+	}
+
+	precision := track.ReleaseDatePrecision
+	if precision == "" {
+		precision = map[int]string{4: "year", 7: "month", 10: "day"}[len(track.ReleaseDate)]
+	}
+
+	albumType := track.AlbumType
+	if albumType == "" {
+		albumType = "album"
+	}
+
+	return map[string]any{
+		"id":           track.ID,
+		"name":         track.Name,
+		"type":         "track",
+		"uri":          "spotify:track:" + track.ID,
+		"duration_ms":  track.DurationMs,
+		"artists":      artists,
+		"external_ids": map[string]any{"isrc": track.ISRC},
+		"album": map[string]any{
+			"id":                     track.ID + "-album",
+			"name":                   track.AlbumName,
+			"album_type":             albumType,
+			"release_date":           track.ReleaseDate,
+			"release_date_precision": precision,
+		},
+	}
+}
+
+func renderDevice(device Device) map[string]any {
+	return map[string]any{
+		"id":              device.ID,
+		"name":            device.Name,
+		"type":            device.Type,
+		"is_active":       device.IsActive,
+		"volume_percent":  50,
+		"supports_volume": true,
+	}
+}
+
+// writeError writes an error in the format of the Web API, optionally with a player error reason.
+func writeError(w http.ResponseWriter, status int, message string, reason string) {
+	body := map[string]any{"status": status, "message": message}
+	if reason != "" {
+		body["reason"] = reason
+	}
+
+	writeJSON(w, status, map[string]any{"error": body})
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]any{"error": code, "error_description": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
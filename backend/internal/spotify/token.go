@@ -0,0 +1,88 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/domnikl/music-box-game/backend/internal/models"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshLeeway is how long before its expiry an access token is refreshed proactively.
+const refreshLeeway = time.Minute
+
+func (s *Spotify) tokenExpiresSoon(user *models.User) bool {
+	return user.SpotifyTokenExpiresAt != nil && s.clock.Now().Add(refreshLeeway).After(*user.SpotifyTokenExpiresAt)
+}
+
+// refreshToken gets a new access token for the user. Concurrent refreshes for the same user are
+// collapsed into a single request to Spotify, the result is shared by all callers. As it is shared,
+// the refresh itself isn't cancelled with ctx, the caller just stops waiting for it.
+func (s *Spotify) refreshToken(ctx context.Context, user *models.User) error {
+	results := s.refreshes.DoChan(strconv.FormatUint(uint64(user.ID), 10), func() (any, error) {
+		return s.doRefreshToken(user)
+	})
+
+	var result singleflight.Result
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case result = <-results:
+	}
+
+	if result.Err != nil {
+		return result.Err
+	}
+
+	refreshed := result.Val.(*models.User)
+	user.SpotifyToken = refreshed.SpotifyToken
+	user.SpotifyRefreshToken = refreshed.SpotifyRefreshToken
+	user.SpotifyTokenExpiresAt = refreshed.SpotifyTokenExpiresAt
+
+	return nil
+}
+
+func (s *Spotify) doRefreshToken(user *models.User) (*models.User, error) {
+	stored, err := s.userService.FindUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.SpotifyLinkBroken() {
+		return nil, ErrTokenRevoked
+	}
+
+	// another request may have refreshed the token in the meantime
+	if stored.SpotifyToken != user.SpotifyToken && !s.tokenExpiresSoon(stored) {
+		return stored, nil
+	}
+
+	tokenSource := s.oauthConfig.TokenSource(s.oauthContext(context.Background()), &oauth2.Token{
+		RefreshToken: stored.SpotifyRefreshToken,
+	})
+
+	token, err := tokenSource.Token()
+	if err != nil {
+		var retrieveError *oauth2.RetrieveError
+		if errors.As(err, &retrieveError) && retrieveError.ErrorCode == "invalid_grant" {
+			if err := s.userService.MarkSpotifyLinkBroken(stored, s.clock.Now()); err != nil {
+				slog.Error("Failed to mark Spotify link as broken: " + err.Error())
+			}
+
+			return nil, ErrTokenRevoked
+		}
+
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+
+	if err := s.userService.LinkSpotify(stored, token.AccessToken, token.RefreshToken, token.Expiry); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}